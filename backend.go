@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	WireguardBackendKernel    = "kernel"    // wireguard kernel module, configured through generic netlink
+	WireguardBackendUserspace = "userspace" // wireguard-go device library inside this process
+	WireguardBackendProcess   = "process"   // /bin/wireguard-go, configured through its UAPI socket
+	WireguardBackendNetstack  = "netstack"  // wireguard-go device library on a gVisor TCP/IP stack, no TUN device
+)
+
+// WireguardTunnel is a running wireguard interface. IpcSet and IpcGet speak the UAPI key=value format
+// without the set=1/get=1 line and without the errno line.
+type WireguardTunnel interface {
+	Name() string
+	Backend() string
+	IpcSet(config string) error
+	IpcGet() (string, error)
+	Close() error
+}
+
+// startWireguardTunnel creates the wireguard interface with the backend of WG_BACKEND
+func startWireguardTunnel(ctx context.Context, wireguardInterfaceName string, profile WireguardQuickConf) (WireguardTunnel, error) {
+
+	switch AppConfig.WireguardBackend {
+	case WireguardBackendKernel:
+		if !kernelBackendUnavailable.Load() {
+			tunnel, err := startKernelTunnel(wireguardInterfaceName, profile)
+			if err == nil {
+				return tunnel, nil
+			}
+			// Other errors belong to the link of this profile, like a name which is already taken
+			if !errors.Is(err, errKernelWireguardUnavailable) {
+				return nil, err
+			}
+			// Without the kernel module every following profile would fail the same way
+			kernelBackendUnavailable.Store(true)
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Kernel wireguard is not available, falling back to %s // %s", WireguardBackendUserspace, err.Error()))
+		}
+		return startUserspaceTunnel(wireguardInterfaceName, profile)
+	case WireguardBackendUserspace:
+		return startUserspaceTunnel(wireguardInterfaceName, profile)
+	case WireguardBackendProcess:
+		return startProcessTunnel(ctx, wireguardInterfaceName)
+	case WireguardBackendNetstack:
+		return startNetstackTunnel(wireguardInterfaceName, profile)
+	}
+
+	return nil, fmt.Errorf("unknown wireguard backend %s", AppConfig.WireguardBackend)
+
+}
+
+// kernelBackendUnavailable is set when the kernel has no wireguard module or generic netlink family
+var kernelBackendUnavailable atomic.Bool
+
+// namespacedTunnel is a tunnel which has to follow its interface into the namespace of WG_NETNS
+type namespacedTunnel interface {
+	setNamespace(namespace *networkNamespace)
+}
+
+// tunnelDevice reads the current state of the tunnel
+func tunnelDevice(tunnel WireguardTunnel) (*UAPIDevice, error) {
+
+	response, err := tunnel.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseUAPIGetResponse(response)
+
+}
+
+// hasTunnelInterface reports whether tunnels are network interfaces which need addresses and routes.
+// Netstack tunnels have none of them, so they run unprivileged.
+func hasTunnelInterface() bool {
+	return AppConfig.WireguardBackend != WireguardBackendNetstack
+}
+
+// usesHostNetwork reports whether tunnels share the network of this process and need policy rules.
+// Tunnels without it never conflict with each other.
+func usesHostNetwork() bool {
+	return hasTunnelInterface() && !AppConfig.NetworkNamespace
+}
+
+// Dialer opens the connections of health checks through a tunnel
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// sourceDialer binds the interface address so that its policy rule routes the connection into the tunnel
+type sourceDialer struct {
+	source net.IP
+}
+
+func (d sourceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+
+	dialer := net.Dialer{}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		dialer.LocalAddr = &net.TCPAddr{IP: d.source}
+	case "udp", "udp4", "udp6":
+		dialer.LocalAddr = &net.UDPAddr{IP: d.source}
+	default:
+		return nil, fmt.Errorf("network %s is not supported", network)
+	}
+
+	return dialer.DialContext(ctx, network, address)
+
+}
+
+// tunnelDialer returns the dialer for health checks from sourceAddress.
+// Tunnels which have their own TCP/IP stack or network namespace dial through it.
+func tunnelDialer(tunnel WireguardTunnel, network *NetworkSetup, sourceAddress string) Dialer {
+
+	if dialer, ok := tunnel.(Dialer); ok {
+		return dialer
+	}
+
+	if network.Namespace != nil {
+		return network.Namespace
+	}
+
+	return sourceDialer{source: net.ParseIP(sourceAddress)}
+
+}
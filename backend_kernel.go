@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Generic netlink API of the wireguard kernel module (include/uapi/linux/wireguard.h)
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfindex    = 1
+	wgDeviceAIfname     = 2
+	wgDeviceAPrivateKey = 3
+	wgDeviceAPublicKey  = 4
+	wgDeviceAFlags      = 5
+	wgDeviceAListenPort = 6
+	wgDeviceAFwmark     = 7
+	wgDeviceAPeers      = 8
+
+	wgDeviceFReplacePeers = 1 << 0
+
+	wgPeerAPublicKey                   = 1
+	wgPeerAPresharedKey                = 2
+	wgPeerAFlags                       = 3
+	wgPeerAEndpoint                    = 4
+	wgPeerAPersistentKeepaliveInterval = 5
+	wgPeerALastHandshakeTime           = 6
+	wgPeerARxBytes                     = 7
+	wgPeerATxBytes                     = 8
+	wgPeerAAllowedIPs                  = 9
+	wgPeerAProtocolVersion             = 10
+
+	wgPeerFRemoveMe          = 1 << 0
+	wgPeerFReplaceAllowedIPs = 1 << 1
+	wgPeerFUpdateOnly        = 1 << 2
+
+	wgAllowedIPAFamily   = 1
+	wgAllowedIPAIPAddr   = 2
+	wgAllowedIPACidrMask = 3
+)
+
+// nlaTypeMask strips the nested and byte order flags from an attribute type
+const nlaTypeMask = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+
+var native = nl.NativeEndian()
+
+// kernelTunnel is a wireguard link of the kernel module configured through generic netlink.
+// The key=value configuration of IpcSet and IpcGet is translated from and to netlink attributes.
+type kernelTunnel struct {
+	name      string
+	family    *netlink.GenlFamily
+	namespace *networkNamespace // set when the link was moved into the namespace of WG_NETNS
+}
+
+// errKernelWireguardUnavailable means the kernel has no wireguard module, so no profile can use the kernel backend
+var errKernelWireguardUnavailable = errors.New("kernel wireguard is not available")
+
+func startKernelTunnel(wireguardInterfaceName string, profile WireguardQuickConf) (WireguardTunnel, error) {
+
+	link := &netlink.Wireguard{LinkAttrs: netlink.NewLinkAttrs()}
+	link.Name = wireguardInterfaceName
+	link.MTU = profile.Interface.MTU
+
+	// Adding the link loads the module if it is not loaded yet, so the generic netlink family is looked up afterwards
+	err := netlink.LinkAdd(link)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOENT) {
+		return nil, fmt.Errorf("%w: %w", errKernelWireguardUnavailable, &NetlinkError{Op: "add", Object: "wireguard link " + wireguardInterfaceName, Err: err})
+	}
+	if err != nil {
+		return nil, &NetlinkError{Op: "add", Object: "wireguard link " + wireguardInterfaceName, Err: err}
+	}
+
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		netlink.LinkDel(link)
+		return nil, fmt.Errorf("%w: generic netlink family %s: %w", errKernelWireguardUnavailable, wgGenlName, err)
+	}
+
+	return &kernelTunnel{
+		name:   wireguardInterfaceName,
+		family: family,
+	}, nil
+
+}
+
+func (t *kernelTunnel) Name() string {
+	return t.name
+}
+
+func (t *kernelTunnel) Backend() string {
+	return WireguardBackendKernel
+}
+
+func (t *kernelTunnel) setNamespace(namespace *networkNamespace) {
+	t.namespace = namespace
+}
+
+// execute sends a request in the namespace of the link
+func (t *kernelTunnel) execute(req *nl.NetlinkRequest) (msgs [][]byte, err error) {
+
+	if t.namespace == nil {
+		return req.Execute(unix.NETLINK_GENERIC, t.family.ID)
+	}
+
+	err = t.namespace.run(func() (err error) {
+		msgs, err = req.Execute(unix.NETLINK_GENERIC, t.family.ID)
+		return
+	})
+
+	return
+
+}
+
+func (t *kernelTunnel) IpcSet(config string) error {
+
+	req := nl.NewNetlinkRequest(int(t.family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: wgCmdSetDevice, Version: wgGenlVersion})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfname, nl.ZeroTerminated(t.name)))
+
+	var deviceFlags uint32
+	var peers, peer, allowedIPs *nl.RtAttr
+	var peerFlags uint32
+	var peerCount, allowedIPCount int
+
+	flushPeer := func() {
+		if peer == nil {
+			return
+		}
+		peer.AddRtAttr(wgPeerAFlags, nl.Uint32Attr(peerFlags))
+		if allowedIPs != nil {
+			peer.AddChild(allowedIPs)
+		}
+		peers.AddChild(peer)
+		peer, peerFlags, allowedIPs, allowedIPCount = nil, 0, nil, 0
+		peerCount++
+	}
+
+	for _, line := range strings.Split(config, "\n") {
+
+		if line == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("invalid uapi line %q", line)
+		}
+
+		if key == "public_key" {
+			flushPeer()
+			publicKey, err := hex.DecodeString(value)
+			if err != nil {
+				return fmt.Errorf("invalid uapi value %q", line)
+			}
+			if peers == nil {
+				peers = nl.NewRtAttr(unix.NLA_F_NESTED|wgDeviceAPeers, nil)
+			}
+			peer = nl.NewRtAttr(unix.NLA_F_NESTED|peerCount, nil)
+			peer.AddRtAttr(wgPeerAPublicKey, publicKey)
+			continue
+		}
+
+		var err error
+
+		if peer == nil {
+			switch key {
+			case "private_key":
+				var privateKey []byte
+				privateKey, err = hex.DecodeString(value)
+				req.AddData(nl.NewRtAttr(wgDeviceAPrivateKey, privateKey))
+			case "listen_port":
+				var port int
+				port, err = strconv.Atoi(value)
+				req.AddData(nl.NewRtAttr(wgDeviceAListenPort, nl.Uint16Attr(uint16(port))))
+			case "fwmark":
+				var fwmark int
+				fwmark, err = strconv.Atoi(value)
+				req.AddData(nl.NewRtAttr(wgDeviceAFwmark, nl.Uint32Attr(uint32(fwmark))))
+			case "replace_peers":
+				if value == "true" {
+					deviceFlags |= wgDeviceFReplacePeers
+				}
+			default:
+				err = errors.New("unsupported key")
+			}
+		} else {
+			switch key {
+			case "preshared_key":
+				var presharedKey []byte
+				presharedKey, err = hex.DecodeString(value)
+				peer.AddRtAttr(wgPeerAPresharedKey, presharedKey)
+			case "endpoint":
+				var endpoint []byte
+				endpoint, err = encodeSockaddr(value)
+				peer.AddRtAttr(wgPeerAEndpoint, endpoint)
+			case "persistent_keepalive_interval":
+				var interval int
+				interval, err = strconv.Atoi(value)
+				peer.AddRtAttr(wgPeerAPersistentKeepaliveInterval, nl.Uint16Attr(uint16(interval)))
+			case "replace_allowed_ips":
+				if value == "true" {
+					peerFlags |= wgPeerFReplaceAllowedIPs
+				}
+			case "remove":
+				if value == "true" {
+					peerFlags |= wgPeerFRemoveMe
+				}
+			case "update_only":
+				if value == "true" {
+					peerFlags |= wgPeerFUpdateOnly
+				}
+			case "allowed_ip":
+				var prefix *net.IPNet
+				_, prefix, err = net.ParseCIDR(value)
+				if err == nil {
+					if allowedIPs == nil {
+						allowedIPs = nl.NewRtAttr(unix.NLA_F_NESTED|wgPeerAAllowedIPs, nil)
+					}
+					allowedIPs.AddChild(encodeAllowedIP(allowedIPCount, prefix))
+					allowedIPCount++
+				}
+			case "protocol_version":
+			default:
+				err = errors.New("unsupported key")
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid uapi value %q", line)
+		}
+
+	}
+
+	flushPeer()
+
+	req.AddData(nl.NewRtAttr(wgDeviceAFlags, nl.Uint32Attr(deviceFlags)))
+	if peers != nil {
+		req.AddData(peers)
+	}
+
+	_, err := t.execute(req)
+	if err != nil {
+		return fmt.Errorf("wireguard set device %s: %w", t.name, err)
+	}
+
+	return nil
+
+}
+
+// IpcGet dumps the device and formats it like a get=1 response
+func (t *kernelTunnel) IpcGet() (string, error) {
+
+	req := nl.NewNetlinkRequest(int(t.family.ID), unix.NLM_F_DUMP)
+	req.AddData(&nl.Genlmsg{Command: wgCmdGetDevice, Version: wgGenlVersion})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfname, nl.ZeroTerminated(t.name)))
+
+	msgs, err := t.execute(req)
+	if err != nil {
+		return "", fmt.Errorf("wireguard get device %s: %w", t.name, err)
+	}
+
+	var b strings.Builder
+	lastPublicKey := ""
+
+	for i, msg := range msgs {
+
+		attrs, err := nl.ParseRouteAttr(msg[nl.SizeofGenlmsg:])
+		if err != nil {
+			return "", err
+		}
+
+		for _, attr := range attrs {
+			switch attr.Attr.Type & nlaTypeMask {
+			case wgDeviceAPrivateKey:
+				if i == 0 {
+					fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(attr.Value))
+				}
+			case wgDeviceAListenPort:
+				if i == 0 {
+					fmt.Fprintf(&b, "listen_port=%d\n", native.Uint16(attr.Value))
+				}
+			case wgDeviceAFwmark:
+				if i == 0 {
+					fmt.Fprintf(&b, "fwmark=%d\n", native.Uint32(attr.Value))
+				}
+			case wgDeviceAPeers:
+				peers, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return "", err
+				}
+				for _, peer := range peers {
+					lastPublicKey, err = formatKernelPeer(&b, peer.Value, lastPublicKey)
+					if err != nil {
+						return "", err
+					}
+				}
+			}
+		}
+
+	}
+
+	return b.String(), nil
+
+}
+
+// formatKernelPeer writes the key=value lines of a peer. A large dump continues the last peer
+// of the previous message with its remaining allowed ips, so its public key is not repeated.
+func formatKernelPeer(b *strings.Builder, value []byte, lastPublicKey string) (string, error) {
+
+	attrs, err := nl.ParseRouteAttr(value)
+	if err != nil {
+		return lastPublicKey, err
+	}
+
+	publicKey := ""
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type & nlaTypeMask {
+		case wgPeerAPublicKey:
+			publicKey = hex.EncodeToString(attr.Value)
+			if publicKey != lastPublicKey {
+				fmt.Fprintf(b, "public_key=%s\n", publicKey)
+			}
+		case wgPeerAEndpoint:
+			if endpoint := decodeSockaddr(attr.Value); endpoint != "" {
+				fmt.Fprintf(b, "endpoint=%s\n", endpoint)
+			}
+		case wgPeerAPersistentKeepaliveInterval:
+			fmt.Fprintf(b, "persistent_keepalive_interval=%d\n", native.Uint16(attr.Value))
+		case wgPeerALastHandshakeTime:
+			if len(attr.Value) >= 16 {
+				fmt.Fprintf(b, "last_handshake_time_sec=%d\n", int64(native.Uint64(attr.Value[0:8])))
+				fmt.Fprintf(b, "last_handshake_time_nsec=%d\n", int64(native.Uint64(attr.Value[8:16])))
+			}
+		case wgPeerARxBytes:
+			fmt.Fprintf(b, "rx_bytes=%d\n", native.Uint64(attr.Value))
+		case wgPeerATxBytes:
+			fmt.Fprintf(b, "tx_bytes=%d\n", native.Uint64(attr.Value))
+		case wgPeerAProtocolVersion:
+			fmt.Fprintf(b, "protocol_version=%d\n", native.Uint32(attr.Value))
+		case wgPeerAAllowedIPs:
+			allowedIPs, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return publicKey, err
+			}
+			for _, allowedIP := range allowedIPs {
+				if prefix := decodeAllowedIP(allowedIP.Value); prefix != "" {
+					fmt.Fprintf(b, "allowed_ip=%s\n", prefix)
+				}
+			}
+		}
+	}
+
+	return publicKey, nil
+
+}
+
+// Close deletes the link. A link in a namespace is deleted with the namespace.
+func (t *kernelTunnel) Close() error {
+
+	if t.namespace != nil {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return err
+	}
+
+	return netlink.LinkDel(link)
+
+}
+
+// encodeSockaddr encodes host:port as struct sockaddr_in or sockaddr_in6
+func encodeSockaddr(endpoint string) ([]byte, error) {
+
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := addr.IP.To4(); ip != nil {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		native.PutUint16(b[0:2], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+		copy(b[4:8], ip)
+		return b, nil
+	}
+
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	native.PutUint16(b[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[8:24], addr.IP.To16())
+	return b, nil
+
+}
+
+func decodeSockaddr(b []byte) string {
+
+	if len(b) < 4 {
+		return ""
+	}
+
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b[2:4])))
+
+	switch native.Uint16(b[0:2]) {
+	case unix.AF_INET:
+		if len(b) >= 8 {
+			return net.JoinHostPort(net.IP(b[4:8]).String(), port)
+		}
+	case unix.AF_INET6:
+		if len(b) >= 24 {
+			return net.JoinHostPort(net.IP(b[8:24]).String(), port)
+		}
+	}
+
+	return ""
+
+}
+
+func encodeAllowedIP(index int, prefix *net.IPNet) *nl.RtAttr {
+
+	family, ip := uint16(syscall.AF_INET6), prefix.IP.To16()
+	if ip4 := prefix.IP.To4(); ip4 != nil {
+		family, ip = syscall.AF_INET, ip4
+	}
+	ones, _ := prefix.Mask.Size()
+
+	attr := nl.NewRtAttr(unix.NLA_F_NESTED|index, nil)
+	attr.AddRtAttr(wgAllowedIPAFamily, nl.Uint16Attr(family))
+	attr.AddRtAttr(wgAllowedIPAIPAddr, ip)
+	attr.AddRtAttr(wgAllowedIPACidrMask, nl.Uint8Attr(uint8(ones)))
+
+	return attr
+
+}
+
+func decodeAllowedIP(value []byte) string {
+
+	attrs, err := nl.ParseRouteAttr(value)
+	if err != nil {
+		return ""
+	}
+
+	var ip net.IP
+	ones := -1
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type & nlaTypeMask {
+		case wgAllowedIPAIPAddr:
+			ip = net.IP(attr.Value)
+		case wgAllowedIPACidrMask:
+			if len(attr.Value) > 0 {
+				ones = int(attr.Value[0])
+			}
+		}
+	}
+
+	if ip == nil || ones < 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/%d", ip.String(), ones)
+
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func TestSockaddr(t *testing.T) {
+
+	tests := []struct {
+		endpoint string
+		size     int
+		want     string
+	}{
+		{endpoint: "192.0.2.1:51820", size: unix.SizeofSockaddrInet4, want: "192.0.2.1:51820"},
+		{endpoint: "[2001:db8::1]:443", size: unix.SizeofSockaddrInet6, want: "[2001:db8::1]:443"},
+		{endpoint: "[::ffff:192.0.2.1]:53", size: unix.SizeofSockaddrInet4, want: "192.0.2.1:53"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.endpoint, func(t *testing.T) {
+
+			b, err := encodeSockaddr(test.endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != test.size {
+				t.Errorf("size = %d, want %d", len(b), test.size)
+			}
+			if endpoint := decodeSockaddr(b); endpoint != test.want {
+				t.Errorf("decodeSockaddr = %s, want %s", endpoint, test.want)
+			}
+
+		})
+	}
+
+	for _, b := range [][]byte{nil, {2, 0}, {0xff, 0xff, 0, 53, 1, 2, 3, 4}} {
+		if endpoint := decodeSockaddr(b); endpoint != "" {
+			t.Errorf("decodeSockaddr(%v) = %s, want empty", b, endpoint)
+		}
+	}
+
+}
+
+func TestAllowedIP(t *testing.T) {
+
+	tests := []string{"0.0.0.0/0", "10.0.0.0/8", "192.0.2.1/32", "::/0", "2001:db8::/32", "fd00::1/128"}
+
+	for i, test := range tests {
+		t.Run(test, func(t *testing.T) {
+
+			_, prefix, err := net.ParseCIDR(test)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			attrs, err := nl.ParseRouteAttr(encodeAllowedIP(i, prefix).Serialize())
+			if err != nil || len(attrs) != 1 {
+				t.Fatalf("attrs = %v, %v", attrs, err)
+			}
+			if int(attrs[0].Attr.Type&nlaTypeMask) != i {
+				t.Errorf("index = %d, want %d", attrs[0].Attr.Type&nlaTypeMask, i)
+			}
+			if allowedIP := decodeAllowedIP(attrs[0].Value); allowedIP != test {
+				t.Errorf("decodeAllowedIP = %s, want %s", allowedIP, test)
+			}
+
+		})
+	}
+
+}
+
+func TestFormatKernelPeer(t *testing.T) {
+
+	publicKey := bytes.Repeat([]byte{0xab}, 32)
+	publicKeyHex := strings.Repeat("ab", 32)
+
+	newPeer := func(endpoint string, allowedIPs ...string) []byte {
+		peer := nl.NewRtAttr(unix.NLA_F_NESTED, nil)
+		peer.AddRtAttr(wgPeerAPublicKey, publicKey)
+		if endpoint != "" {
+			b, err := encodeSockaddr(endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peer.AddRtAttr(wgPeerAEndpoint, b)
+		}
+		peer.AddRtAttr(wgPeerAPersistentKeepaliveInterval, nl.Uint16Attr(25))
+		peer.AddRtAttr(wgPeerARxBytes, nl.Uint64Attr(92))
+		nested := nl.NewRtAttr(unix.NLA_F_NESTED|wgPeerAAllowedIPs, nil)
+		for i, allowedIP := range allowedIPs {
+			_, prefix, err := net.ParseCIDR(allowedIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nested.AddChild(encodeAllowedIP(i, prefix))
+		}
+		peer.AddChild(nested)
+		return peer.Serialize()[unix.SizeofNlAttr:]
+	}
+
+	tests := []struct {
+		name          string
+		value         []byte
+		lastPublicKey string
+		want          string
+	}{
+		{
+			name:  "peer",
+			value: newPeer("[2001:db8::1]:51820", "0.0.0.0/0", "::/0"),
+			want: "public_key=" + publicKeyHex + "\nendpoint=[2001:db8::1]:51820\npersistent_keepalive_interval=25\nrx_bytes=92\n" +
+				"allowed_ip=0.0.0.0/0\nallowed_ip=::/0\n",
+		},
+		{
+			name:          "continued peer",
+			value:         newPeer("", "10.0.0.0/8"),
+			lastPublicKey: publicKeyHex,
+			want:          "persistent_keepalive_interval=25\nrx_bytes=92\nallowed_ip=10.0.0.0/8\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var b strings.Builder
+			lastPublicKey, err := formatKernelPeer(&b, test.value, test.lastPublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lastPublicKey != publicKeyHex {
+				t.Errorf("public key = %s, want %s", lastPublicKey, publicKeyHex)
+			}
+			if b.String() != test.want {
+				t.Errorf("lines = %q, want %q", b.String(), test.want)
+			}
+
+		})
+	}
+
+}
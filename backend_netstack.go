@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// netstackTunnel is a wireguard-go device whose packets go to a gVisor TCP/IP stack in this process.
+// Health checks dial through the stack, so no TUN device, route or capability is needed.
+type netstackTunnel struct {
+	name   string
+	device *device.Device
+	net    *netstack.Net
+}
+
+func startNetstackTunnel(wireguardInterfaceName string, profile WireguardQuickConf) (WireguardTunnel, error) {
+
+	var localAddresses, dnsServers []netip.Addr
+
+	for _, address := range profile.Interface.Addresses {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return nil, err
+		}
+		localAddresses = append(localAddresses, prefix.Addr())
+	}
+
+	for _, dns := range profile.Interface.DNSs {
+		addr, err := netip.ParseAddr(dns)
+		if err != nil {
+			return nil, err
+		}
+		dnsServers = append(dnsServers, addr)
+	}
+
+	mtu := profile.Interface.MTU
+	if mtu == 0 {
+		mtu = device.DefaultMTU
+	}
+
+	tunDevice, tnet, err := netstack.CreateNetTUN(localAddresses, dnsServers, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create netstack: %w", err)
+	}
+
+	// The netstack tun reports itself up on creation, which brings the device up
+	wgDevice := device.NewDevice(tunDevice, conn.NewDefaultBind(), newWireguardLogger(wireguardInterfaceName))
+
+	return &netstackTunnel{
+		name:   wireguardInterfaceName,
+		device: wgDevice,
+		net:    tnet,
+	}, nil
+
+}
+
+func (t *netstackTunnel) Name() string {
+	return t.name
+}
+
+func (t *netstackTunnel) Backend() string {
+	return WireguardBackendNetstack
+}
+
+func (t *netstackTunnel) IpcSet(config string) error {
+	return t.device.IpcSet(config)
+}
+
+func (t *netstackTunnel) IpcGet() (string, error) {
+	return t.device.IpcGet()
+}
+
+// DialContext supports tcp, udp and ping (icmp echo) networks with a 4 or 6 suffix.
+// A hostname is resolved first like the checks of the other backends do, instead of with the DNS of the profile.
+func (t *netstackTunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+
+	if network != "ping4" && network != "ping6" {
+		var err error
+		address, err = resolveDialAddress(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t.net.DialContext(ctx, network, address)
+
+}
+
+func (t *netstackTunnel) Close() error {
+	t.device.Close()
+	<-t.device.Wait()
+	return nil
+}
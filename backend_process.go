@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const WireguardGoPath = "/bin/wireguard-go"
+
+// WireguardGoStartTimeout is how long wireguard-go may take to open its UAPI socket
+const WireguardGoStartTimeout = 5 * time.Second
+
+// processTunnel is a wireguard-go process configured through its UAPI socket
+type processTunnel struct {
+	name   string
+	cmd    *exec.Cmd
+	sock   net.Conn
+	exited chan struct{}
+}
+
+func startProcessTunnel(ctx context.Context, wireguardInterfaceName string) (WireguardTunnel, error) {
+
+	cmd := exec.Command(WireguardGoPath, "-f", wireguardInterfaceName)
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, "LOG_LEVEL=debug")
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("cannot start wireguard-go: %w", err)
+	}
+
+	t := &processTunnel{
+		name:   wireguardInterfaceName,
+		cmd:    cmd,
+		exited: make(chan struct{}),
+	}
+
+	go func() {
+
+		logOutput := func(r io.Reader, done chan struct{}) {
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				debugMessage(DEBUG_SHOW_WIREGUARD_MESSAGE, scanner.Text())
+			}
+			close(done)
+		}
+
+		stdoutDone, stderrDone := make(chan struct{}), make(chan struct{})
+		go logOutput(stdout, stdoutDone)
+		go logOutput(stderr, stderrDone)
+		<-stdoutDone
+		<-stderrDone
+
+		err := cmd.Wait()
+		if err != nil {
+			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("wireguard-go %s exited // %s", wireguardInterfaceName, err.Error()))
+		}
+		close(t.exited)
+
+	}()
+
+	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "Waiting for wireguard running up")
+
+	ctx, cancel := context.WithTimeout(ctx, WireguardGoStartTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.Close()
+			if ctx.Err() == context.Canceled {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("uapi socket of %s was not opened in %s", wireguardInterfaceName, WireguardGoStartTimeout)
+		case <-t.exited:
+			t.Close()
+			return nil, errors.New("wireguard-go exited before opening the uapi socket")
+		default:
+		}
+
+		sock, err := net.Dial("unix", uapiSocketPath(wireguardInterfaceName))
+		if err == nil {
+			t.sock = sock
+			return t, nil
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+}
+
+func (t *processTunnel) Name() string {
+	return t.name
+}
+
+func (t *processTunnel) Backend() string {
+	return WireguardBackendProcess
+}
+
+func (t *processTunnel) IpcSet(config string) error {
+	_, err := uapiRequest(t.sock, "set=1\n"+config+"\n")
+	return err
+}
+
+func (t *processTunnel) IpcGet() (string, error) {
+	return uapiRequest(t.sock, "get=1\n\n")
+}
+
+// Close kills wireguard-go and waits until it has exited
+func (t *processTunnel) Close() error {
+
+	if t.sock != nil {
+		t.sock.Close()
+	}
+
+	select {
+	case <-t.exited:
+		return nil
+	default:
+	}
+
+	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("killing wireguard %d", t.cmd.Process.Pid))
+	err := t.cmd.Process.Kill()
+	<-t.exited
+
+	return err
+
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// userspaceTunnel is a wireguard-go device running in this process on a TUN interface
+type userspaceTunnel struct {
+	name   string
+	device *device.Device
+}
+
+func startUserspaceTunnel(wireguardInterfaceName string, profile WireguardQuickConf) (WireguardTunnel, error) {
+
+	mtu := profile.Interface.MTU
+	if mtu == 0 {
+		mtu = device.DefaultMTU
+	}
+
+	tunDevice, err := tun.CreateTUN(wireguardInterfaceName, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create tun %s: %w", wireguardInterfaceName, err)
+	}
+
+	// The device is brought up by the tun up event when the link is set up
+	wgDevice := device.NewDevice(tunDevice, conn.NewDefaultBind(), newWireguardLogger(wireguardInterfaceName))
+
+	return &userspaceTunnel{
+		name:   wireguardInterfaceName,
+		device: wgDevice,
+	}, nil
+
+}
+
+// newWireguardLogger sends the device log to DEBUG_SHOW_WIREGUARD_MESSAGE
+func newWireguardLogger(wireguardInterfaceName string) *device.Logger {
+	logf := func(format string, args ...any) {
+		debugMessage(DEBUG_SHOW_WIREGUARD_MESSAGE, fmt.Sprintf("(%s) %s", wireguardInterfaceName, fmt.Sprintf(format, args...)))
+	}
+	return &device.Logger{
+		Verbosef: logf,
+		Errorf:   logf,
+	}
+}
+
+func (t *userspaceTunnel) Name() string {
+	return t.name
+}
+
+func (t *userspaceTunnel) Backend() string {
+	return WireguardBackendUserspace
+}
+
+func (t *userspaceTunnel) IpcSet(config string) error {
+	return t.device.IpcSet(config)
+}
+
+func (t *userspaceTunnel) IpcGet() (string, error) {
+	return t.device.IpcGet()
+}
+
+// Close stops the device and removes its TUN interface
+func (t *userspaceTunnel) Close() error {
+	t.device.Close()
+	<-t.device.Wait()
+	return nil
+}
@@ -2,19 +2,29 @@ module github.com/kerus1024/wireguard-connectivity-test2
 
 go 1.21
 
-require github.com/go-ping/ping v1.1.0
+require (
+	github.com/go-ping/ping v1.1.0
+	github.com/miekg/dns v1.1.56
+	github.com/vishvananda/netlink v1.3.1
+	github.com/vishvananda/netns v0.0.5
+	golang.zx2c4.com/wireguard v0.0.0-20231211153847-12269c276173
+	gopkg.in/ini.v1 v1.67.0
+)
 
 require (
-	github.com/miekg/dns v1.1.56 // indirect
+	github.com/google/btree v1.0.1 // indirect
+	golang.org/x/crypto v0.13.0 // indirect
 	golang.org/x/mod v0.12.0 // indirect
+	golang.org/x/time v0.0.0-20220210224613-90d013bbcef8 // indirect
 	golang.org/x/tools v0.13.0 // indirect
-	gopkg.in/ini.v1 v1.67.0 // indirect
+	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
+	gvisor.dev/gvisor v0.0.0-20230927004350-cbd86285d259 // indirect
 )
 
 require (
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/prometheus-community/pro-bing v0.3.0
-	golang.org/x/net v0.15.0 // indirect
+	golang.org/x/net v0.15.0
 	golang.org/x/sync v0.3.0 // indirect
-	golang.org/x/sys v0.12.0 // indirect
+	golang.org/x/sys v0.12.0
 )
@@ -1,279 +1,364 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
-
-	"github.com/miekg/dns"
-	probing "github.com/prometheus-community/pro-bing"
 )
 
 type HealthCheckResult struct {
+	Family         int
+	Method         string
+	Source         string // interface address the check was sent from
+	Target         string
+	Attempts       int
+	PacketsSent    int // icmp echo requests, or one probe per attempt for the other methods
+	RTTs           []time.Duration
 	SuccessMessage string
 	Error          error
+	ErrorCode      string
+	Assertion      string // option of the check which the answer did not satisfy
+	HTTP           *HTTPResult
+	TLS            *TLSResult
+	DNS            *DNSResult
+	DNSServers     []DNSServerResult // DNS servers of the profile
 }
 
-func healthCheckICMP(subJobSequence int, workerNum int, job WireguardJob) *HealthCheckResult {
+func newHealthCheckResult(method string, sourceAddress string, target string) *HealthCheckResult {
+	return &HealthCheckResult{
+		Method: method,
+		Source: sourceAddress,
+		Target: target,
+	}
+}
 
-	jobDescrption := fmt.Sprintf("[Worker#%d,Subjob#%d,%s,%s/icmp] ", workerNum, subJobSequence, job.Profile.Interface.Address, AppConfig.HealthCheckEndpoint)
+// addProbes records sent probes and the round trip times of the answered ones
+func (hr *HealthCheckResult) addProbes(sent int, rtts ...time.Duration) {
+	hr.PacketsSent += sent
+	hr.RTTs = append(hr.RTTs, rtts...)
+}
 
-	ctx, _ := context.WithTimeout(context.Background(), AppConfig.HealthCheckRunTimeout)
-	err := errors.New(jobDescrption + "ICMP ping was not run")
+// PacketLoss returns the percentage of unanswered probes. -1 if nothing was sent.
+func (hr *HealthCheckResult) PacketLoss() float64 {
+	if hr.PacketsSent == 0 {
+		return -1
+	}
+	return float64(hr.PacketsSent-len(hr.RTTs)) / float64(hr.PacketsSent) * 100
+}
 
-	retries := 0
+func (hr *HealthCheckResult) fail(code string, err error) *HealthCheckResult {
+	hr.Error = err
+	hr.ErrorCode = code
+	return hr
+}
 
-	for err != nil && retries < AppConfig.HealthCheckRetries {
-		if retries != 0 {
-			err = errors.New(jobDescrption + "ICMP Ping was failed")
-		}
-		select {
-		case <-ctx.Done():
-			debugMessage(DEBUG_SHOW_STATISTICS_MESSAGE, jobDescrption+"Context Timeout Exceeded")
-			return &HealthCheckResult{Error: errors.New(jobDescrption + "timeout context")}
-		default:
-
-			pinger, err := probing.NewPinger(AppConfig.HealthCheckEndpoint)
-			if err != nil {
-				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, jobDescrption+err.Error())
-				return &HealthCheckResult{Error: err}
-			}
-			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, jobDescrption+"pinging...")
-			pinger.SetPrivileged(false)
+// checkErrorCode tells a refused connection and a timeout from other check failures
+func checkErrorCode(err error) string {
+	// gVisor reports a refused connection as text
+	if errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), "connection was refused") {
+		return ErrorCodeCheckRefused
+	}
+	if errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) {
+		return ErrorCodeCheckTimeout
+	}
+	return ErrorCodeCheckError
+}
 
-			pinger.Source = job.Profile.Interface.Address
-			pinger.Interval = 250 * time.Millisecond
-			pinger.Count = 3
-			pinger.Timeout = 800 * time.Millisecond
-			pinger.Size = 112
+func (hr *HealthCheckResult) succeed(message string) *HealthCheckResult {
+	hr.SuccessMessage = message
+	return hr
+}
 
-			pinger.OnRecv = func(pkt *probing.Packet) {
-				debugMessage(DEBUG_SHOW_STATISTICS_MESSAGE, fmt.Sprintf("%sicmp_seq=%d time=%v", jobDescrption, pkt.Seq, pkt.Rtt))
-			}
+// healthCheckEndpoint returns the target for the ip family. HEALTHCHECK_ENDPOINT6 overrides the IPv6 target.
+func healthCheckEndpoint(family int) string {
+	if family == 6 && AppConfig.HealthCheckEndpoint6 != "" {
+		return AppConfig.HealthCheckEndpoint6
+	}
+	return AppConfig.HealthCheckEndpoint
+}
 
-			isError := false
+// HealthCheck is one check of HEALTHCHECKS. An empty endpoint is the one of HEALTHCHECK_ENDPOINT.
+type HealthCheck struct {
+	Name      string          `json:"name,omitempty"`
+	Method    string          `json:"method"`
+	Endpoint  string          `json:"endpoint,omitempty"`
+	Endpoint6 string          `json:"endpoint6,omitempty"` // IPv6 target, Endpoint if empty
+	Options   json.RawMessage `json:"options,omitempty"`   // method specific, see ParseConfig of the checker
+}
 
-			err = pinger.Run() // Blocks until finished.
-			if err != nil {
-				isError = true
-				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, jobDescrption+err.Error())
-			}
+// endpoint returns the target of the check for the ip family
+func (c HealthCheck) endpoint(family int) string {
+	if family == 6 && c.Endpoint6 != "" {
+		return c.Endpoint6
+	}
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return healthCheckEndpoint(family)
+}
 
-			if pinger.Statistics().PacketLoss >= 0.99 {
-				isError = true
-			} else {
-				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, jobDescrption+"ping successful")
-			}
+// configuredHealthChecks returns HEALTHCHECKS, or the check of HEALTHCHECK_METHOD if it is not set
+func configuredHealthChecks() []HealthCheck {
+	if len(AppConfig.HealthChecks) > 0 {
+		return AppConfig.HealthChecks
+	}
+	return []HealthCheck{{Method: AppConfig.HealthCheckMethod}}
+}
 
-			if isError {
-				retries++
-				time.Sleep(AppConfig.HealthCheckInterval)
-			} else {
-				return &HealthCheckResult{SuccessMessage: fmt.Sprintf("%s%d bytes rtt=%dms", jobDescrption, pinger.Size, pinger.Statistics().MinRtt.Milliseconds())}
-			}
+const (
+	HealthCheckPolicyAll    = "all"    // every check has to pass
+	HealthCheckPolicyAny    = "any"    // one check has to pass
+	HealthCheckPolicyQuorum = "quorum" // quorum:N, N checks have to pass
+)
 
-		}
+// parseHealthCheckPolicy validates a value of HEALTHCHECK_POLICY
+func parseHealthCheckPolicy(policy string) error {
+
+	switch policy {
+	case HealthCheckPolicyAll, HealthCheckPolicyAny:
+		return nil
 	}
 
-	if err == nil {
-		return &HealthCheckResult{Error: errors.New(jobDescrption + "unknown error")}
+	quorum, ok := strings.CutPrefix(policy, HealthCheckPolicyQuorum+":")
+	if !ok {
+		return fmt.Errorf("unknown policy %s", policy)
 	}
 
-	return &HealthCheckResult{Error: err}
+	n, err := strconv.Atoi(quorum)
+	if err != nil || n < 1 {
+		return fmt.Errorf("quorum of %s is not a positive number", policy)
+	}
+
+	return nil
+
 }
 
-func healthCheckDNS(subJobSequence int, workerNum int, job WireguardJob) *HealthCheckResult {
+// healthCheckQuorum returns how many of count checks have to pass under the policy
+func healthCheckQuorum(policy string, count int) int {
+
+	switch policy {
+	case HealthCheckPolicyAll:
+		return count
+	case HealthCheckPolicyAny:
+		return 1
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(policy, HealthCheckPolicyQuorum+":"))
+	if err != nil {
+		return count
+	}
 
-	jobDescrption := fmt.Sprintf("[Worker#%d,Subjob#%d,%s,%s:53/dns] ", workerNum, subJobSequence, job.Profile.Interface.Address, AppConfig.HealthCheckEndpoint)
+	return n
 
-	ctx, _ := context.WithTimeout(context.Background(), AppConfig.HealthCheckRunTimeout)
-	err := errors.New(jobDescrption + "DNS query request was not run")
+}
 
-	retries := 0
+// checkHealthCheckQuorum rejects a quorum which count checks can never reach
+func checkHealthCheckQuorum(policy string, count int) error {
 
-	for err != nil && retries < AppConfig.HealthCheckRetries {
-		if retries != 0 {
-			err = errors.New(jobDescrption + "DNS request was failed... timeout occured")
-		}
-		select {
-		case <-ctx.Done():
-			debugMessage(DEBUG_SHOW_STATISTICS_MESSAGE, fmt.Sprintf("%sContext Timeout Exceeded", jobDescrption))
-			return &HealthCheckResult{Error: errors.New(jobDescrption + "timeout context")}
-		default:
-
-			m1 := new(dns.Msg)
-			m1.Id = dns.Id()
-			m1.RecursionDesired = true
-			m1.Question = []dns.Question{
-				{Name: ".", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			}
+	if quorum := healthCheckQuorum(policy, count); quorum > count {
+		return fmt.Errorf("quorum of %s is larger than the %d checks", policy, count)
+	}
 
-			c := new(dns.Client)
-			laddr := net.UDPAddr{
-				IP: net.ParseIP(job.Profile.Interface.Address),
-			}
+	return nil
 
-			c.Dialer = &net.Dialer{
-				Timeout:   2000 * time.Millisecond,
-				LocalAddr: &laddr,
-			}
+}
 
-			_, rtt, err := c.Exchange(m1, fmt.Sprintf("%s:%d", AppConfig.HealthCheckEndpoint, 53))
-			if err != nil {
-				retries++
-				debugMessage(DEBUG_SHOW_ERROR_MESSAGE, jobDescrption+err.Error())
-				time.Sleep(AppConfig.HealthCheckInterval)
-				continue
-			} else {
-				return &HealthCheckResult{SuccessMessage: fmt.Sprintf("%srtt=%dms", jobDescrption, rtt.Milliseconds())}
-			}
+// resolveHealthCheckHost returns host as an address of the ip family, resolving it if it is a name.
+// Every method and backend resolves with the resolver of the host, so that a name means the same target everywhere.
+func resolveHealthCheckHost(ctx context.Context, host string, family int) (net.IP, error) {
 
+	if ip := net.ParseIP(host); ip != nil {
+		if ipFamily(ip) != family {
+			return nil, fmt.Errorf("%s is not an IPv%d address", host, family)
 		}
+		return ip, nil
 	}
 
-	if err == nil {
-		return &HealthCheckResult{Error: errors.New(jobDescrption + "unknown error")}
+	ips, err := net.DefaultResolver.LookupIP(ctx, fmt.Sprintf("ip%d", family), host)
+	if err != nil {
+		return nil, err
 	}
 
-	return &HealthCheckResult{Error: err}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s has no IPv%d address", host, family)
+	}
 
+	return ips[0], nil
 }
 
-func healthCheckTCP(subJobSequence int, workerNum int, job WireguardJob) *HealthCheckResult {
+// resolveDialAddress replaces the host of host:port with an address of the ip family of network (tcp4, udp6...)
+func resolveDialAddress(ctx context.Context, network, address string) (string, error) {
 
-	jobDescrption := fmt.Sprintf("[Worker#%d,Subjob#%d,%s,%s/tcp] ", workerNum, subJobSequence, job.Profile.Interface.Address, AppConfig.HealthCheckEndpoint)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
 
-	ctx, _ := context.WithTimeout(context.Background(), AppConfig.HealthCheckRunTimeout)
-	err := errors.New(jobDescrption + "TCP Connect was not run")
+	family := 4
+	if strings.HasSuffix(network, "6") {
+		family = 6
+	}
 
-	retries := 0
+	ip, err := resolveHealthCheckHost(ctx, host, family)
+	if err != nil {
+		return "", err
+	}
 
-	for err != nil && retries < AppConfig.HealthCheckRetries {
-		if retries != 0 {
-			err = errors.New(jobDescrption + "TCP Connect was failed... timeout occured")
-		}
-		select {
-		case <-ctx.Done():
-			debugMessage(DEBUG_SHOW_STATISTICS_MESSAGE, jobDescrption+"Context timeout occured")
-			return &HealthCheckResult{Error: errors.New(jobDescrption + "timeout context")}
-		default:
-
-			startTime := time.Now()
-
-			client := net.Dialer{
-				Timeout: AppConfig.HealthCheckTimeout,
-				LocalAddr: &net.TCPAddr{
-					IP: net.ParseIP(job.Profile.Interface.Address),
-				},
-			}
-			conn, err := client.Dial("tcp", AppConfig.HealthCheckEndpoint)
-			if err != nil {
-				debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("%s%s", jobDescrption, err.Error()))
-				if errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) {
-					retries++
-					time.Sleep(AppConfig.HealthCheckInterval)
-					continue
-				} else {
-					return &HealthCheckResult{Error: err}
-				}
-			} else {
-				conn.Close()
-				rtt := time.Since(startTime)
-				return &HealthCheckResult{SuccessMessage: fmt.Sprintf("%srtt=%dms", jobDescrption, rtt.Milliseconds())}
-			}
+	return net.JoinHostPort(ip.String(), port), nil
+
+}
+
+// sleepContext sleeps for d. It returns the error of ctx if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
 
+// HealthChecker is a kind of health check. Every kind lives in its own hc_<method>.go file
+// and registers itself in init, so that HEALTHCHECK_METHOD can select it.
+type HealthChecker interface {
+	// Name is the value of HEALTHCHECK_METHOD
+	Name() string
+	// ParseConfig returns a checker with the options of the method, a json object. nil options are the defaults.
+	ParseConfig(options json.RawMessage) (HealthChecker, error)
+	// Check runs one attempt through the tunnel and records its probes in hr. It returns a message on success.
+	// Failures of ErrorCodeCheckTimeout are retried, every other failure ends the check.
+	Check(ctx context.Context, target HealthCheckTarget, hr *HealthCheckResult) (string, error)
+}
+
+// HealthCheckTarget is the tunnel of one ip family which a check runs through
+type HealthCheckTarget struct {
+	Family        int
+	SourceAddress string   // interface address of the family
+	Endpoint      string   // HEALTHCHECK_ENDPOINT, or HEALTHCHECK_ENDPOINT6 for IPv6
+	DNSServers    []string // DNS of the profile
+	Dialer        Dialer
+	Timeout       time.Duration // HEALTHCHECK_TIMEOUT of the profile, for one attempt
+	RunTimeout    time.Duration // HEALTHCHECK_RUNTIMEOUT of the profile, for every attempt
+	Description   string        // prefix of the log messages and result messages
+}
+
+var healthCheckers = make(map[string]HealthChecker) // key=method
+
+func registerHealthChecker(checker HealthChecker) {
+	healthCheckers[checker.Name()] = checker
+}
+
+// newHealthChecker returns the registered checker of method configured with options
+func newHealthChecker(method string, options json.RawMessage) (HealthChecker, error) {
+
+	checker, ok := healthCheckers[method]
+	if !ok {
+		return nil, fmt.Errorf("health check method %s is not implemented", method)
+	}
+
+	checker, err := checker.ParseConfig(options)
+	if err != nil {
+		return nil, fmt.Errorf("%s health check options error: %w", method, err)
+	}
+
+	return checker, nil
+
+}
+
+// checkHealthChecks rejects a check with an unknown method or invalid options before any tunnel is set up
+func checkHealthChecks(checks []HealthCheck) error {
+
+	for i, check := range checks {
+		_, err := newHealthChecker(check.Method, check.Options)
+		if err != nil {
+			if check.Name != "" {
+				return fmt.Errorf("check %s: %w", check.Name, err)
+			}
+			return fmt.Errorf("check #%d: %w", i+1, err)
 		}
 	}
 
-	if err == nil {
-		return &HealthCheckResult{Error: errors.New("unknown error")}
+	return nil
+
+}
+
+// parseHealthCheckOptions decodes options into v. Unknown fields are an error, so that a typo is not silently ignored.
+func parseHealthCheckOptions(options json.RawMessage, v any) error {
+
+	if len(options) == 0 || string(options) == "null" {
+		return nil
 	}
 
-	return &HealthCheckResult{Error: err}
+	decoder := json.NewDecoder(bytes.NewReader(options))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(v)
 
 }
 
-func healthCheckHTTP(subJobSequence int, workerNum int, job WireguardJob) *HealthCheckResult {
+// runHealthCheck runs attempts of the checker until one succeeds, one fails for another reason than a timeout,
+// HEALTHCHECK_RETRIES attempts were made or the run timeout of the target expired. HEALTHCHECK_INTERVAL is waited between attempts.
+func runHealthCheck(ctx context.Context, checker HealthChecker, target HealthCheckTarget) *HealthCheckResult {
 
-	jobDescrption := fmt.Sprintf("[Worker#%d,Subjob#%d,%s,http_%s] ", workerNum, subJobSequence, job.Profile.Interface.Address, AppConfig.HealthCheckEndpoint)
+	hr := newHealthCheckResult(checker.Name(), target.SourceAddress, target.Endpoint)
+	hr.Family = target.Family
 
-	ctx, _ := context.WithTimeout(context.Background(), AppConfig.HealthCheckRunTimeout)
-	err := errors.New(jobDescrption + "HTTP Request was not run")
+	ctx, cancel := context.WithTimeout(ctx, target.RunTimeout)
+	defer cancel()
 
-	retries := 0
+	err := errors.New("health check was not run")
+	code := ErrorCodeCheckError
 
-	for err != nil && retries < AppConfig.HealthCheckRetries {
-		if retries != 0 {
-			err = errors.New(jobDescrption + "HTTP Request was failed... timeout occured")
-		}
-		select {
-		case <-ctx.Done():
-			debugMessage(DEBUG_SHOW_STATISTICS_MESSAGE, jobDescrption+"Context timeout occured")
-			return &HealthCheckResult{Error: errors.New(jobDescrption + "timeout context")}
-		default:
-
-			startTime := time.Now()
-
-			client := http.Client{
-				Timeout: AppConfig.HealthCheckTimeout,
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						InsecureSkipVerify: true,
-					},
-					DialContext: (&net.Dialer{
-						LocalAddr: &net.TCPAddr{
-							IP: net.ParseIP(job.Profile.Interface.Address),
-						},
-					}).DialContext,
-					DisableKeepAlives: true,
-				},
-			}
+	// The interval doubles after every retry. A retry which would start after the run timeout is not waited for.
+	interval := AppConfig.HealthCheckInterval
 
-			parsedUrl, err := url.Parse(AppConfig.HealthCheckEndpoint)
-			if err != nil {
-				return &HealthCheckResult{Error: errors.New(jobDescrption + err.Error())}
-			}
+	for hr.Attempts < AppConfig.HealthCheckRetries {
 
-			req := http.Request{
-				Method: "GET",
-				URL:    parsedUrl,
+		if hr.Attempts != 0 {
+			if deadline, ok := ctx.Deadline(); ok && interval >= time.Until(deadline) {
+				break
 			}
+			if sleepContext(ctx, interval) != nil {
+				break
+			}
+			interval *= 2
+		}
 
-			// NOTE: https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
-			resp, err := client.Do(&req)
-			if err != nil {
-				debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("%s%s", jobDescrption, err.Error()))
-				if errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) {
-					retries++
-					time.Sleep(AppConfig.HealthCheckInterval)
-				} else {
-					return &HealthCheckResult{Error: err}
-				}
-			} else {
-				defer resp.Body.Close()
-				rtt := time.Since(startTime)
-
-				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-					return &HealthCheckResult{SuccessMessage: fmt.Sprintf("%srtt=%dms", jobDescrption, rtt.Milliseconds())}
-				} else {
-					return &HealthCheckResult{Error: errors.New(fmt.Sprintf("%sRemote server returned status code: %d, rtt=%dms", jobDescrption, resp.StatusCode, rtt.Milliseconds()))}
-				}
+		hr.Attempts++
 
-			}
+		var message string
+		message, err = checker.Check(ctx, target, hr)
+		if err == nil {
+			return hr.succeed(target.Description + message)
+		}
 
+		code = errorCode(err)
+		if code == "" {
+			code = checkErrorCode(err)
 		}
+		debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("%sattempt %d // %s", target.Description, hr.Attempts, err.Error()))
+
+		if code != ErrorCodeCheckTimeout {
+			break
+		}
+
 	}
 
-	if err == nil {
-		return &HealthCheckResult{Error: errors.New("unknown error")}
+	if ctx.Err() != nil && code == ErrorCodeCheckTimeout {
+		debugMessage(DEBUG_SHOW_STATISTICS_MESSAGE, target.Description+"Context timeout occured")
+		return hr.fail(ErrorCodeCheckTimeout, fmt.Errorf("%stimeout context // %s", target.Description, err.Error()))
 	}
 
-	return &HealthCheckResult{Error: err}
+	return hr.fail(code, errors.New(target.Description+err.Error()))
 
 }
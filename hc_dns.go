@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const HCMethodDNS = "dns"
+
+// dnsChecker sends a query to the endpoint. Without options any answer of an A query for "." over udp to port 53 is a success.
+type dnsChecker struct {
+	options dnsCheckOptions
+	qtype   uint16
+	rcodes  []int
+}
+
+// dnsCheckOptions are the options of HEALTHCHECKS for the dns method
+type dnsCheckOptions struct {
+	Name      string   `json:"name"`      // query name, "." if empty
+	Type      string   `json:"type"`      // query type, A if empty
+	Port      int      `json:"port"`      // 53 if 0
+	Transport string   `json:"transport"` // udp or tcp, udp if empty. A truncated udp answer is asked again over tcp.
+	EDNS0     bool     `json:"edns0"`     // add an OPT record
+	DO        bool     `json:"do"`        // set the DNSSEC OK bit, implies edns0
+	RCode     []string `json:"rcode"`     // accepted rcodes, any rcode if empty
+	Answers   []string `json:"answers"`   // values which have to be in the answer section, e.g. an address of an A query
+}
+
+// DNSResult is the answer of a dns check
+type DNSResult struct {
+	RCode         string   `json:"rcode"`
+	Answers       []string `json:"answers,omitempty"`
+	Authenticated bool     `json:"ad,omitempty"`
+	Transport     string   `json:"transport,omitempty"` // tcp if the answer was asked again over tcp
+	Connect       float64  `json:"connect,omitempty"`   // milliseconds of the tcp connection of dot and doh
+	Handshake     float64  `json:"handshake,omitempty"` // milliseconds of the TLS handshake of dot and doh
+	Query         float64  `json:"query,omitempty"`     // milliseconds from the handshake to the answer of dot and doh
+
+	answerTypes []uint16 // record type of each of Answers
+}
+
+// setLatency records the phases of a query over a new TLS connection
+func (r *DNSResult) setLatency(start time.Time, connected time.Time, handshaked time.Time, answered time.Time) {
+	r.Connect = durationMilliseconds(connected.Sub(start))
+	r.Handshake = durationMilliseconds(handshaked.Sub(connected))
+	r.Query = durationMilliseconds(answered.Sub(handshaked))
+}
+
+// DNSUDPSize is the udp payload size of the OPT record, the one of DNS flag day 2020
+const DNSUDPSize = 1232
+
+func init() {
+	registerHealthChecker(dnsChecker{})
+}
+
+func (dnsChecker) Name() string {
+	return HCMethodDNS
+}
+
+func (dnsChecker) ParseConfig(options json.RawMessage) (HealthChecker, error) {
+
+	c := dnsChecker{}
+
+	err := parseHealthCheckOptions(options, &c.options)
+	if err != nil {
+		return nil, err
+	}
+
+	c.qtype, c.rcodes, err = c.options.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+
+}
+
+// parse validates the options and returns the query type and the accepted rcodes
+func (o *dnsCheckOptions) parse() (uint16, []int, error) {
+
+	if o.Name == "" {
+		o.Name = "."
+	}
+	o.Name = dns.Fqdn(o.Name)
+
+	if o.Type == "" {
+		o.Type = "A"
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(o.Type)]
+	if !ok {
+		return 0, nil, fmt.Errorf("type %s is not a dns type", o.Type)
+	}
+
+	if o.Port == 0 {
+		o.Port = 53
+	}
+
+	switch o.Transport {
+	case "":
+		o.Transport = "udp"
+	case "udp", "tcp":
+	default:
+		return 0, nil, fmt.Errorf("transport %s is not udp or tcp", o.Transport)
+	}
+
+	var rcodes []int
+	for _, name := range o.RCode {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(name)]
+		if !ok {
+			return 0, nil, fmt.Errorf("rcode %s is not a dns rcode", name)
+		}
+		rcodes = append(rcodes, rcode)
+	}
+
+	return qtype, rcodes, nil
+
+}
+
+// query returns the query message of the options
+func (o dnsCheckOptions) query(qtype uint16) *dns.Msg {
+
+	m := new(dns.Msg)
+	m.Id = dns.Id()
+	m.RecursionDesired = true
+	m.Question = []dns.Question{
+		{Name: o.Name, Qtype: qtype, Qclass: dns.ClassINET},
+	}
+
+	if o.EDNS0 || o.DO {
+		m.SetEdns0(DNSUDPSize, o.DO)
+	}
+
+	return m
+
+}
+
+func (c dnsChecker) Check(ctx context.Context, target HealthCheckTarget, hr *HealthCheckResult) (string, error) {
+
+	targetIP, err := resolveHealthCheckHost(ctx, target.Endpoint, target.Family)
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, err)
+	}
+	hr.Target = net.JoinHostPort(targetIP.String(), strconv.Itoa(c.options.Port))
+
+	result, rtt, err := c.exchange(ctx, target, hr.Target)
+	if err != nil {
+		hr.addProbes(1)
+		return "", err
+	}
+	hr.addProbes(1, rtt)
+	hr.DNS = result
+
+	assertion, err := c.assertAnswer(result)
+	if err != nil {
+		hr.Assertion = assertion
+		return "", err
+	}
+
+	return fmt.Sprintf("%s %s %s rtt=%dms", c.options.Name, dns.TypeToString[c.qtype], result.RCode, rtt.Milliseconds()), nil
+
+}
+
+// exchange sends the query of the options to address. A truncated udp answer is asked again over tcp.
+func (c dnsChecker) exchange(ctx context.Context, target HealthCheckTarget, address string) (*DNSResult, time.Duration, error) {
+
+	client := &dns.Client{Timeout: target.Timeout}
+
+	startTime := time.Now()
+	transport := c.options.Transport
+
+	r, _, err := exchangeDNS(ctx, client, target.Dialer, fmt.Sprintf("%s%d", transport, target.Family), c.options.query(c.qtype), address)
+	if err == nil && r.Truncated && transport == "udp" {
+		transport = "tcp"
+		r, _, err = exchangeDNS(ctx, client, target.Dialer, fmt.Sprintf("%s%d", transport, target.Family), c.options.query(c.qtype), address)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rtt := time.Since(startTime)
+
+	result := newDNSResult(r)
+	if transport != c.options.Transport {
+		result.Transport = transport
+	}
+
+	return result, rtt, nil
+
+}
+
+// assertAnswer checks the rcode and the answer values of a response. It returns the name of the failed assertion.
+func (c dnsChecker) assertAnswer(result *DNSResult) (string, error) {
+
+	accepted := len(c.rcodes) == 0
+	for _, rcode := range c.rcodes {
+		if result.RCode == dns.RcodeToString[rcode] {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return "rcode", newCodedError(ErrorCodeDNSRCode, fmt.Errorf("%s %s got rcode %s", c.options.Name, dns.TypeToString[c.qtype], result.RCode))
+	}
+
+	for _, expected := range c.options.Answers {
+		if !containsDNSValue(result.Answers, result.answerTypes, expected) {
+			return "answers", newCodedError(ErrorCodeDNSAnswer, fmt.Errorf("%s %s has no answer %s", c.options.Name, dns.TypeToString[c.qtype], expected))
+		}
+	}
+
+	return "", nil
+
+}
+
+func newDNSResult(r *dns.Msg) *DNSResult {
+
+	result := &DNSResult{
+		RCode:         dns.RcodeToString[r.Rcode],
+		Authenticated: r.AuthenticatedData,
+	}
+
+	for _, rr := range r.Answer {
+		result.Answers = append(result.Answers, dnsValue(rr))
+		result.answerTypes = append(result.answerTypes, rr.Header().Rrtype)
+	}
+
+	return result
+
+}
+
+// dnsValue returns the data of a record as text: the address of A and AAAA, the joined strings of TXT
+// and the presentation format without the header for the other types
+func dnsValue(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String()
+	case *dns.AAAA:
+		return rr.AAAA.String()
+	case *dns.TXT:
+		return strings.Join(rr.Txt, "")
+	}
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+// containsDNSValue compares names without case and trailing dot. TXT data is case sensitive and compared as it is.
+func containsDNSValue(values []string, types []uint16, expected string) bool {
+	for i, value := range values {
+		if types[i] == dns.TypeTXT {
+			if value == expected {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(strings.TrimSuffix(value, "."), strings.TrimSuffix(expected, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeDNS sends the query over a connection of the dialer
+func exchangeDNS(ctx context.Context, c *dns.Client, dialer Dialer, network string, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	dialContext, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(dialContext, network, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	return c.ExchangeWithConnContext(dialContext, m, &dns.Conn{Conn: conn})
+
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSValue(t *testing.T) {
+
+	tests := []struct {
+		record string
+		value  string
+	}{
+		{record: "example.com. 300 IN A 192.0.2.1", value: "192.0.2.1"},
+		{record: "example.com. 300 IN AAAA 2001:db8::0001", value: "2001:db8::1"},
+		{record: `example.com. 300 IN TXT "v=spf1 " "-all"`, value: "v=spf1 -all"},
+		{record: "www.example.com. 300 IN CNAME Example.com.", value: "Example.com."},
+		{record: "example.com. 300 IN MX 10 mail.example.com.", value: "10 mail.example.com."},
+		{record: "example.com. 300 IN NS ns1.example.com.", value: "ns1.example.com."},
+		{record: "_sip._tcp.example.com. 300 IN SRV 10 5 5060 sip.example.com.", value: "10 5 5060 sip.example.com."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.record, func(t *testing.T) {
+
+			rr, err := dns.NewRR(test.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if value := dnsValue(rr); value != test.value {
+				t.Errorf("dnsValue = %q, want %q", value, test.value)
+			}
+
+		})
+	}
+
+}
+
+func TestContainsDNSValue(t *testing.T) {
+
+	values := []string{"192.0.2.1", "Example.com.", "10 mail.example.com.", "v=spf1 Include:example.com -all"}
+	types := []uint16{dns.TypeA, dns.TypeCNAME, dns.TypeMX, dns.TypeTXT}
+
+	tests := []struct {
+		expected string
+		contains bool
+	}{
+		{expected: "192.0.2.1", contains: true},
+		{expected: "example.com", contains: true},
+		{expected: "EXAMPLE.COM.", contains: true},
+		{expected: "10 mail.example.com", contains: true},
+		{expected: "192.0.2.10"},
+		{expected: "www.example.com"},
+		{expected: "mail.example.com."},
+		{expected: "v=spf1 Include:example.com -all", contains: true},
+		{expected: "v=spf1 include:example.com -all"},
+		{expected: "v=spf1 Include:example.com -all."},
+		{expected: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expected, func(t *testing.T) {
+			if contains := containsDNSValue(values, types, test.expected); contains != test.contains {
+				t.Errorf("containsDNSValue = %t, want %t", contains, test.contains)
+			}
+		})
+	}
+
+}
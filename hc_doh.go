@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const HCMethodDoH = "doh"
+
+// DNSMessageContentType is the media type of a query and its answer over HTTPS
+const DNSMessageContentType = "application/dns-message"
+
+// dohChecker sends the query of the dns method over HTTPS (RFC 8484) to the endpoint, an url like https://dns.example/dns-query.
+// The certificate of the resolver is verified like the one of an https check.
+type dohChecker struct {
+	dnsChecker
+	tls       tlsCheckOptions
+	tlsConfig *tls.Config
+	method    string
+}
+
+// dohCheckOptions are the options of HEALTHCHECKS for the doh method
+type dohCheckOptions struct {
+	encryptedDNSCheckOptions
+	Method string `json:"method"` // POST or GET, POST if empty
+}
+
+func init() {
+	registerHealthChecker(dohChecker{})
+}
+
+func (dohChecker) Name() string {
+	return HCMethodDoH
+}
+
+func (dohChecker) ParseConfig(options json.RawMessage) (HealthChecker, error) {
+
+	var o dohCheckOptions
+
+	err := parseHealthCheckOptions(options, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Transport != "" || o.Port != 0 {
+		return nil, fmt.Errorf("transport and port are not options of %s, the endpoint url sets them", HCMethodDoH)
+	}
+
+	c := dohChecker{tls: o.tlsCheckOptions}
+	c.options = o.dnsCheckOptions
+
+	switch o.Method {
+	case "", http.MethodPost:
+		c.method = http.MethodPost
+	case http.MethodGet:
+		c.method = http.MethodGet
+	default:
+		return nil, fmt.Errorf("method %s is not POST or GET", o.Method)
+	}
+
+	c.qtype, c.rcodes, err = c.options.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	c.tlsConfig, err = c.tls.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+
+}
+
+func (c dohChecker) Check(ctx context.Context, target HealthCheckTarget, hr *HealthCheckResult) (string, error) {
+
+	parsedUrl, err := url.Parse(target.Endpoint)
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, err)
+	}
+	if parsedUrl.Scheme != "https" {
+		return "", newCodedError(ErrorCodeCheckError, fmt.Errorf("%s is not an https url", target.Endpoint))
+	}
+
+	// The id is 0 so that answers can be cached (RFC 8484 4.1)
+	m := c.options.query(c.qtype)
+	m.Id = 0
+	data, err := m.Pack()
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, err)
+	}
+
+	var body io.Reader
+	if c.method == http.MethodGet {
+		query := parsedUrl.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(data))
+		parsedUrl.RawQuery = query.Encode()
+	} else {
+		body = bytes.NewReader(data)
+	}
+
+	var connectTime, handshakeTime time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			handshakeTime = time.Now()
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), c.method, parsedUrl.String(), body)
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, err)
+	}
+	req.Header.Set("Accept", DNSMessageContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", DNSMessageContentType)
+	}
+
+	client := http.Client{
+		Timeout: target.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: c.tls.verifiedConfig(c.tlsConfig, &hr.TLS),
+			// The dialers of the backends do not all report to httptrace, so the connection is timed here
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := target.Dialer.DialContext(ctx, fmt.Sprintf("tcp%d", target.Family), addr)
+				connectTime = time.Now()
+				return conn, err
+			},
+			DisableKeepAlives: true,
+			ForceAttemptHTTP2: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	startTime := time.Now()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		hr.addProbes(1)
+		return "", tlsCheckError(err, hr)
+	}
+	defer resp.Body.Close()
+
+	// A DNS message is at most 65535 bytes
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		hr.addProbes(1)
+		return "", err
+	}
+
+	answerTime := time.Now()
+	hr.addProbes(1, answerTime.Sub(startTime))
+
+	if resp.StatusCode != http.StatusOK {
+		hr.HTTP = &HTTPResult{Status: resp.StatusCode}
+		hr.Assertion = "status"
+		return "", newCodedError(ErrorCodeHTTPStatus, fmt.Errorf("Remote server returned status code: %d", resp.StatusCode))
+	}
+
+	r := new(dns.Msg)
+	err = r.Unpack(answer)
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, fmt.Errorf("answer of %s is not a dns message: %w", resp.Header.Get("Content-Type"), err))
+	}
+
+	hr.DNS = newDNSResult(r)
+	hr.DNS.setLatency(startTime, connectTime, handshakeTime, answerTime)
+
+	assertion, err := c.assertAnswer(hr.DNS)
+	if err != nil {
+		hr.Assertion = assertion
+		return "", err
+	}
+
+	return fmt.Sprintf("%s %s %s handshake=%dms query=%dms", c.options.Name, dns.TypeToString[c.qtype], hr.DNS.RCode, handshakeTime.Sub(connectTime).Milliseconds(), answerTime.Sub(handshakeTime).Milliseconds()), nil
+
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const HCMethodDoT = "dot"
+
+// dotChecker sends the query of the dns method over TLS (RFC 7858) to the endpoint. The certificate of the resolver
+// is verified for the endpoint, or for servername if the endpoint is an address which is not in the certificate.
+type dotChecker struct {
+	dnsChecker
+	tls       tlsCheckOptions
+	tlsConfig *tls.Config
+}
+
+// encryptedDNSCheckOptions are the options of HEALTHCHECKS for the dot and doh methods, those of dns and the TLS options of http
+type encryptedDNSCheckOptions struct {
+	dnsCheckOptions
+	tlsCheckOptions
+}
+
+func init() {
+	registerHealthChecker(dotChecker{})
+}
+
+func (dotChecker) Name() string {
+	return HCMethodDoT
+}
+
+func (dotChecker) ParseConfig(options json.RawMessage) (HealthChecker, error) {
+
+	var o encryptedDNSCheckOptions
+
+	err := parseHealthCheckOptions(options, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Transport != "" {
+		return nil, fmt.Errorf("transport is not an option of %s", HCMethodDoT)
+	}
+	if o.Port == 0 {
+		o.Port = 853
+	}
+
+	c := dotChecker{tls: o.tlsCheckOptions}
+	c.options = o.dnsCheckOptions
+
+	c.qtype, c.rcodes, err = c.options.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	c.tlsConfig, err = c.tls.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+
+}
+
+func (c dotChecker) Check(ctx context.Context, target HealthCheckTarget, hr *HealthCheckResult) (string, error) {
+
+	targetIP, err := resolveHealthCheckHost(ctx, target.Endpoint, target.Family)
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, err)
+	}
+	hr.Target = net.JoinHostPort(targetIP.String(), strconv.Itoa(c.options.Port))
+
+	config := c.tls.verifiedConfig(c.tlsConfig, &hr.TLS)
+	if config.ServerName == "" {
+		config.ServerName = target.Endpoint
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, target.Timeout)
+	defer cancel()
+
+	startTime := time.Now()
+
+	conn, err := target.Dialer.DialContext(ctx, fmt.Sprintf("tcp%d", target.Family), hr.Target)
+	if err != nil {
+		hr.addProbes(1)
+		return "", err
+	}
+	defer conn.Close()
+
+	connectTime := time.Now()
+
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		hr.addProbes(1)
+		return "", tlsCheckError(err, hr)
+	}
+
+	handshakeTime := time.Now()
+
+	client := &dns.Client{Timeout: target.Timeout}
+	r, _, err := client.ExchangeWithConnContext(ctx, c.options.query(c.qtype), &dns.Conn{Conn: tlsConn})
+	if err != nil {
+		hr.addProbes(1)
+		return "", err
+	}
+
+	answerTime := time.Now()
+	hr.addProbes(1, answerTime.Sub(startTime))
+
+	hr.DNS = newDNSResult(r)
+	hr.DNS.setLatency(startTime, connectTime, handshakeTime, answerTime)
+
+	assertion, err := c.assertAnswer(hr.DNS)
+	if err != nil {
+		hr.Assertion = assertion
+		return "", err
+	}
+
+	return fmt.Sprintf("%s %s %s handshake=%dms query=%dms", c.options.Name, dns.TypeToString[c.qtype], hr.DNS.RCode, handshakeTime.Sub(connectTime).Milliseconds(), answerTime.Sub(handshakeTime).Milliseconds()), nil
+
+}
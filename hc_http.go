@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HCMethodHTTP = "http"
+
+// HTTPBodyLimit is the most of a response body which is read for the body assertions
+const HTTPBodyLimit = 1 << 20
+
+// httpChecker sends a request to the endpoint, an url. Without options a GET request which gets a 2xx status is a success.
+type httpChecker struct {
+	options   httpCheckOptions
+	status    []httpStatusRange
+	regex     *regexp.Regexp
+	tlsConfig *tls.Config
+}
+
+// httpCheckOptions are the options of HEALTHCHECKS for the http method
+type httpCheckOptions struct {
+	Method          string            `json:"method"`          // GET if empty
+	Headers         map[string]string `json:"headers"`         // request headers, Host sets the virtual host
+	Body            string            `json:"body"`            // request body
+	Status          []httpStatusRange `json:"status"`          // accepted status codes, 2xx if empty
+	MaxRedirects    *int              `json:"maxredirects"`    // redirects which are followed, 10 if not set. 0 checks the redirect response itself.
+	BodyContains    string            `json:"bodycontains"`    // the response body contains it
+	BodyRegex       string            `json:"bodyregex"`       // the response body matches it
+	JSON            map[string]any    `json:"json"`            // key=dot separated path into the json response body, value=expected value
+	ResponseHeaders map[string]string `json:"responseheaders"` // key=header, value=text which the header contains
+	tlsCheckOptions
+}
+
+// HTTPResult is the response of an http check
+type HTTPResult struct {
+	Status    int    `json:"status"`
+	Redirects int    `json:"redirects,omitempty"`
+	URL       string `json:"url,omitempty"` // url of the response after redirects
+}
+
+// httpStatusRange is an accepted status of the status option: 200, "200", "2xx" (or "2XX") or "200-299"
+type httpStatusRange struct {
+	min, max int
+}
+
+func (r *httpStatusRange) UnmarshalJSON(data []byte) error {
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	s = strings.ToLower(s)
+
+	var err error
+	switch {
+	case len(s) == 3 && strings.HasSuffix(s, "xx"):
+		r.min, err = strconv.Atoi(s[:1] + "00")
+		r.max = r.min + 99
+	case strings.Contains(s, "-"):
+		low, high, _ := strings.Cut(s, "-")
+		r.min, err = strconv.Atoi(strings.TrimSpace(low))
+		if err == nil {
+			r.max, err = strconv.Atoi(strings.TrimSpace(high))
+		}
+	default:
+		r.min, err = strconv.Atoi(s)
+		r.max = r.min
+	}
+
+	if err != nil || r.min < 100 || r.max > 599 || r.min > r.max {
+		return fmt.Errorf("status %s is not a status code, Nxx or a range", s)
+	}
+
+	return nil
+
+}
+
+func (r httpStatusRange) contains(status int) bool {
+	return status >= r.min && status <= r.max
+}
+
+// errTooManyRedirects stops a request which exceeded maxredirects
+var errTooManyRedirects = errors.New("too many redirects")
+
+func init() {
+	registerHealthChecker(httpChecker{})
+}
+
+func (httpChecker) Name() string {
+	return HCMethodHTTP
+}
+
+func (httpChecker) ParseConfig(options json.RawMessage) (HealthChecker, error) {
+
+	c := httpChecker{}
+
+	err := parseHealthCheckOptions(options, &c.options)
+	if err != nil {
+		return nil, err
+	}
+
+	c.status = c.options.Status
+	if len(c.status) == 0 {
+		c.status = []httpStatusRange{{min: 200, max: 299}}
+	}
+
+	if c.options.BodyRegex != "" {
+		c.regex, err = regexp.Compile(c.options.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("bodyregex error: %w", err)
+		}
+	}
+
+	if c.options.MaxRedirects != nil && *c.options.MaxRedirects < 0 {
+		return nil, fmt.Errorf("maxredirects %d is negative", *c.options.MaxRedirects)
+	}
+
+	c.tlsConfig, err = c.options.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+
+}
+
+func (c httpChecker) Check(ctx context.Context, target HealthCheckTarget, hr *HealthCheckResult) (string, error) {
+
+	parsedUrl, err := url.Parse(target.Endpoint)
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, err)
+	}
+
+	maxRedirects := 10
+	if c.options.MaxRedirects != nil {
+		maxRedirects = *c.options.MaxRedirects
+	}
+
+	redirects := 0
+
+	client := http.Client{
+		Timeout: target.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: c.options.verifiedConfig(c.tlsConfig, &hr.TLS),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return target.Dialer.DialContext(ctx, fmt.Sprintf("tcp%d", target.Family), addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if maxRedirects == 0 {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > maxRedirects {
+				return errTooManyRedirects
+			}
+			redirects = len(via)
+			return nil
+		},
+	}
+
+	method := c.options.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if c.options.Body != "" {
+		body = strings.NewReader(c.options.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, parsedUrl.String(), body)
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, err)
+	}
+	for key, value := range c.options.Headers {
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+
+	startTime := time.Now()
+
+	// NOTE: https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
+	resp, err := client.Do(req)
+	if err != nil {
+		hr.addProbes(1)
+		if errors.Is(err, errTooManyRedirects) {
+			hr.Assertion = "maxredirects"
+			return "", newCodedError(ErrorCodeHTTPAssertion, fmt.Errorf("stopped after %d redirects", maxRedirects))
+		}
+		return "", tlsCheckError(err, hr)
+	}
+	defer resp.Body.Close()
+
+	rtt := time.Since(startTime)
+	hr.addProbes(1, rtt)
+
+	hr.HTTP = &HTTPResult{Status: resp.StatusCode, Redirects: redirects}
+	if redirects > 0 {
+		hr.HTTP.URL = resp.Request.URL.String()
+	}
+
+	if !c.acceptsStatus(resp.StatusCode) {
+		hr.Assertion = "status"
+		return "", newCodedError(ErrorCodeHTTPStatus, fmt.Errorf("Remote server returned status code: %d, rtt=%dms", resp.StatusCode, rtt.Milliseconds()))
+	}
+
+	assertion, err := c.assertResponse(resp)
+	if err != nil {
+		hr.Assertion = assertion
+		return "", newCodedError(ErrorCodeHTTPAssertion, fmt.Errorf("%s assertion failed: %s, status=%d", assertion, err.Error(), resp.StatusCode))
+	}
+
+	return fmt.Sprintf("status=%d rtt=%dms", resp.StatusCode, rtt.Milliseconds()), nil
+
+}
+
+func (c httpChecker) acceptsStatus(status int) bool {
+	for _, r := range c.status {
+		if r.contains(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// assertResponse checks the headers and the body of the response. It returns the name of the failed assertion.
+func (c httpChecker) assertResponse(resp *http.Response) (string, error) {
+
+	// In the order of the keys, so that the first failed assertion is the same on every run
+	for _, key := range sortedKeys(c.options.ResponseHeaders) {
+		expected := c.options.ResponseHeaders[key]
+		value := resp.Header.Get(key)
+		if !strings.Contains(value, expected) {
+			return "responseheaders." + key, fmt.Errorf("%q does not contain %q", value, expected)
+		}
+	}
+
+	if c.options.BodyContains == "" && c.regex == nil && len(c.options.JSON) == 0 {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, HTTPBodyLimit))
+	if err != nil {
+		return "body", err
+	}
+
+	if c.options.BodyContains != "" && !strings.Contains(string(body), c.options.BodyContains) {
+		return "bodycontains", fmt.Errorf("body does not contain %q", c.options.BodyContains)
+	}
+
+	if c.regex != nil && !c.regex.Match(body) {
+		return "bodyregex", fmt.Errorf("body does not match %q", c.options.BodyRegex)
+	}
+
+	if len(c.options.JSON) > 0 {
+
+		var document any
+		err = json.Unmarshal(body, &document)
+		if err != nil {
+			return "json", fmt.Errorf("body is not json: %s", err.Error())
+		}
+
+		for _, path := range sortedKeys(c.options.JSON) {
+			expected := c.options.JSON[path]
+			value, ok := jsonPathValue(document, path)
+			if !ok {
+				return "json." + path, errors.New("path does not exist")
+			}
+			if !reflect.DeepEqual(value, expected) {
+				return "json." + path, fmt.Errorf("value %v is not %v", value, expected)
+			}
+		}
+
+	}
+
+	return "", nil
+
+}
+
+// jsonPathValue returns the value at a dot separated path of object keys and array indexes, e.g. data.items.0.id
+func jsonPathValue(document any, path string) (any, bool) {
+
+	value := document
+
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTTPStatusRange(t *testing.T) {
+
+	tests := []struct {
+		status string // JSON value
+		min    int
+		max    int
+		err    bool
+	}{
+		{status: `200`, min: 200, max: 200},
+		{status: `"204"`, min: 204, max: 204},
+		{status: `"2xx"`, min: 200, max: 299},
+		{status: `"2XX"`, min: 200, max: 299},
+		{status: `"5Xx"`, min: 500, max: 599},
+		{status: `"200-299"`, min: 200, max: 299},
+		{status: `"400 - 404"`, min: 400, max: 404},
+		{status: `"404-400"`, err: true},
+		{status: `"6xx"`, err: true},
+		{status: `"0xx"`, err: true},
+		{status: `"2xxx"`, err: true},
+		{status: `99`, err: true},
+		{status: `600`, err: true},
+		{status: `"ok"`, err: true},
+		{status: `"200-"`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+
+			var r httpStatusRange
+			err := json.Unmarshal([]byte(test.status), &r)
+			if test.err {
+				if err == nil {
+					t.Fatalf("no error, range %d-%d", r.min, r.max)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.min != test.min || r.max != test.max {
+				t.Errorf("range = %d-%d, want %d-%d", r.min, r.max, test.min, test.max)
+			}
+			if !r.contains(test.min) || !r.contains(test.max) || r.contains(test.min-1) || r.contains(test.max+1) {
+				t.Errorf("contains of %d-%d is wrong", r.min, r.max)
+			}
+
+		})
+	}
+
+}
+
+func TestJSONPathValue(t *testing.T) {
+
+	var document any
+	err := json.Unmarshal([]byte(`{"status": "ok", "count": 3, "data": {"items": [{"id": 1}, {"id": 2, "tags": ["a", "b"]}], "empty": null},
+		"a.b": true}`), &document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		value any
+		found bool
+	}{
+		{path: "status", value: "ok", found: true},
+		{path: "count", value: float64(3), found: true},
+		{path: "data.items.0.id", value: float64(1), found: true},
+		{path: "data.items.1.tags.1", value: "b", found: true},
+		{path: "data.items.1", value: map[string]any{"id": float64(2), "tags": []any{"a", "b"}}, found: true},
+		{path: "data.empty", value: nil, found: true},
+		{path: "data.items.2.id"},
+		{path: "data.items.-1"},
+		{path: "data.items.x"},
+		{path: "status.length"},
+		{path: "data.empty.id"},
+		{path: "missing"},
+		{path: "a.b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+
+			value, found := jsonPathValue(document, test.path)
+			if found != test.found {
+				t.Fatalf("found = %t, want %t", found, test.found)
+			}
+			if !reflect.DeepEqual(value, test.value) {
+				t.Errorf("value = %#v, want %#v", value, test.value)
+			}
+
+		})
+	}
+
+}
+
+func TestAssertResponse(t *testing.T) {
+
+	checker := httpChecker{options: httpCheckOptions{
+		ResponseHeaders: map[string]string{"X-C": "c", "X-A": "a", "X-B": "b", "Content-Type": "json"},
+		JSON:            map[string]any{"z": "1", "b": "2", "m": "3"},
+	}}
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		body      string
+		assertion string
+	}{
+		{name: "every header fails", header: http.Header{}, assertion: "responseheaders.Content-Type"},
+		{name: "later headers fail", header: http.Header{"Content-Type": {"application/json"}, "X-B": {"b"}}, assertion: "responseheaders.X-A"},
+		{name: "every path fails", header: http.Header{"Content-Type": {"application/json"}, "X-A": {"a"}, "X-B": {"b"}, "X-C": {"c"}}, body: `{}`, assertion: "json.b"},
+		{name: "pass", header: http.Header{"Content-Type": {"application/json"}, "X-A": {"a"}, "X-B": {"b"}, "X-C": {"c"}}, body: `{"z": "1", "b": "2", "m": "3"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// maps are ranged in a random order, so a stable assertion has to hold on every run
+			for i := 0; i < 20; i++ {
+				resp := &http.Response{Header: test.header, Body: io.NopCloser(strings.NewReader(test.body))}
+				assertion, _ := checker.assertResponse(resp)
+				if assertion != test.assertion {
+					t.Fatalf("assertion = %q, want %q", assertion, test.assertion)
+				}
+			}
+		})
+	}
+
+}
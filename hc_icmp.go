@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const HCMethodICMP = "icmp"
+
+const (
+	ICMPPacketCount = 3
+	ICMPPacketSize  = 112
+	ICMPInterval    = 250 * time.Millisecond
+	ICMPTimeout     = 800 * time.Millisecond // for all packets of an attempt
+)
+
+// pingSource pings from the interface address with an unprivileged icmp socket of the host
+func pingSource(ctx context.Context, endpoint string, targetIP net.IP, sourceAddress string, jobDescrption string) (*probing.Statistics, error) {
+
+	pinger := probing.New(endpoint)
+	pinger.SetIPAddr(&net.IPAddr{IP: targetIP})
+	pinger.SetPrivileged(false)
+
+	pinger.Source = sourceAddress
+	pinger.Interval = ICMPInterval
+	pinger.Count = ICMPPacketCount
+	pinger.Timeout = ICMPTimeout
+	pinger.Size = ICMPPacketSize
+
+	pinger.OnRecv = func(pkt *probing.Packet) {
+		debugMessage(DEBUG_SHOW_STATISTICS_MESSAGE, fmt.Sprintf("%sicmp_seq=%d time=%v", jobDescrption, pkt.Seq, pkt.Rtt))
+	}
+
+	err := pinger.RunWithContext(ctx) // Blocks until finished.
+
+	return pinger.Statistics(), err
+
+}
+
+// pingDialer pings over a ping connection of the dialer, the same way as pingSource
+func pingDialer(ctx context.Context, dialer Dialer, targetIP net.IP, jobDescrption string) (*probing.Statistics, error) {
+
+	stats := &probing.Statistics{}
+
+	family := ipFamily(targetIP)
+	requestType, replyType, protocol := icmp.Type(ipv4.ICMPTypeEcho), icmp.Type(ipv4.ICMPTypeEchoReply), 1
+	if family == 6 {
+		requestType, replyType, protocol = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, 58
+	}
+
+	conn, err := dialer.DialContext(ctx, fmt.Sprintf("ping%d", family), targetIP.String())
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(ICMPTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	// A cancelled context interrupts the blocked read
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	payload := make([]byte, ICMPPacketSize)
+	buf := make([]byte, 1500)
+
+Send:
+	for seq := 0; seq < ICMPPacketCount; seq++ {
+
+		if seq != 0 && sleepContext(ctx, ICMPInterval) != nil {
+			break
+		}
+
+		request, err := (&icmp.Message{Type: requestType, Body: &icmp.Echo{Seq: seq, Data: payload}}).Marshal(nil)
+		if err != nil {
+			return stats, err
+		}
+
+		startTime := time.Now()
+		_, err = conn.Write(request)
+		if err != nil {
+			return stats, err
+		}
+		stats.PacketsSent++
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				// deadline of the attempt
+				break Send
+			}
+
+			reply, err := icmp.ParseMessage(protocol, buf[:n])
+			if err != nil || reply.Type != replyType {
+				continue
+			}
+
+			if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq {
+				rtt := time.Since(startTime)
+				debugMessage(DEBUG_SHOW_STATISTICS_MESSAGE, fmt.Sprintf("%sicmp_seq=%d time=%v", jobDescrption, seq, rtt))
+				stats.PacketsRecv++
+				stats.Rtts = append(stats.Rtts, rtt)
+				if stats.MinRtt == 0 || rtt < stats.MinRtt {
+					stats.MinRtt = rtt
+				}
+				break
+			}
+		}
+
+	}
+
+	if stats.PacketsSent > 0 {
+		stats.PacketLoss = float64(stats.PacketsSent-stats.PacketsRecv) / float64(stats.PacketsSent) * 100
+	}
+
+	return stats, nil
+
+}
+
+// icmpChecker sends ICMPPacketCount echo requests to the endpoint. An attempt succeeds if any of them is answered.
+type icmpChecker struct{}
+
+func init() {
+	registerHealthChecker(icmpChecker{})
+}
+
+func (icmpChecker) Name() string {
+	return HCMethodICMP
+}
+
+func (c icmpChecker) ParseConfig(options json.RawMessage) (HealthChecker, error) {
+	return c, parseHealthCheckOptions(options, &struct{}{})
+}
+
+func (icmpChecker) Check(ctx context.Context, target HealthCheckTarget, hr *HealthCheckResult) (string, error) {
+
+	targetIP, err := resolveHealthCheckHost(ctx, target.Endpoint, target.Family)
+	if err != nil {
+		return "", newCodedError(ErrorCodeCheckError, err)
+	}
+	hr.Target = targetIP.String()
+
+	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, target.Description+"pinging...")
+
+	var stats *probing.Statistics
+	if _, ok := target.Dialer.(sourceDialer); ok {
+		stats, err = pingSource(ctx, target.Endpoint, targetIP, target.SourceAddress, target.Description)
+	} else {
+		stats, err = pingDialer(ctx, target.Dialer, targetIP, target.Description)
+	}
+
+	hr.addProbes(stats.PacketsSent, stats.Rtts...)
+
+	if err != nil {
+		return "", err
+	}
+
+	if stats.PacketsRecv == 0 {
+		return "", newCodedError(ErrorCodeCheckTimeout, fmt.Errorf("no reply of %d echo requests", stats.PacketsSent))
+	}
+
+	return fmt.Sprintf("%d bytes rtt=%dms", ICMPPacketSize, stats.MinRtt.Milliseconds()), nil
+
+}
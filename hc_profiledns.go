@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const HCMethodProfileDNS = "profiledns"
+
+// profileDNSChecker sends the query of the dns method to every DNS server of the profile of the ip family instead of the endpoint.
+// Every server has to answer. If a name is set it also has to resolve, with NOERROR unless rcode is set and with at least one answer.
+type profileDNSChecker struct {
+	dnsChecker
+	resolve bool // name is set
+}
+
+// DNSServerResult is the answer of one DNS server of the profile
+type DNSServerResult struct {
+	Server string     `json:"server"`
+	RTT    float64    `json:"rtt,omitempty"` // milliseconds
+	DNS    *DNSResult `json:"dns,omitempty"`
+	Code   string     `json:"code,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+func init() {
+	registerHealthChecker(profileDNSChecker{})
+}
+
+func (profileDNSChecker) Name() string {
+	return HCMethodProfileDNS
+}
+
+func (profileDNSChecker) ParseConfig(options json.RawMessage) (HealthChecker, error) {
+
+	c := profileDNSChecker{}
+
+	err := parseHealthCheckOptions(options, &c.options)
+	if err != nil {
+		return nil, err
+	}
+
+	c.resolve = c.options.Name != ""
+
+	c.qtype, c.rcodes, err = c.options.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.resolve && len(c.rcodes) == 0 {
+		c.rcodes = []int{dns.RcodeSuccess}
+	}
+
+	return c, nil
+
+}
+
+func (c profileDNSChecker) Check(ctx context.Context, target HealthCheckTarget, hr *HealthCheckResult) (string, error) {
+
+	// Every attempt queries every server again, so nothing of a previous attempt is kept
+	hr.DNSServers = nil
+	hr.Assertion = ""
+
+	var servers []string
+	for _, server := range target.DNSServers {
+		if ipFamily(net.ParseIP(server)) == target.Family {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return "", newCodedError(ErrorCodeCheckError, fmt.Errorf("profile has no IPv%d DNS server", target.Family))
+	}
+	hr.Target = strings.Join(servers, ",")
+
+	var failedServers []string
+	var firstError *DNSServerResult
+	var messages []string
+
+	for _, server := range servers {
+
+		serverResult := DNSServerResult{Server: server}
+
+		assertion := ""
+		result, rtt, err := c.exchange(ctx, target, net.JoinHostPort(server, strconv.Itoa(c.options.Port)))
+		if err == nil {
+			hr.addProbes(1, rtt)
+			serverResult.RTT = durationMilliseconds(rtt)
+			serverResult.DNS = result
+			assertion, err = c.assertAnswer(result)
+		} else {
+			hr.addProbes(1)
+		}
+
+		if err == nil {
+			messages = append(messages, fmt.Sprintf("%s rtt=%dms", server, rtt.Milliseconds()))
+		} else {
+			serverResult.Code = errorCode(err)
+			if serverResult.Code == "" {
+				serverResult.Code = checkErrorCode(err)
+			}
+			serverResult.Error = err.Error()
+			failedServers = append(failedServers, server)
+			if firstError == nil {
+				firstError = &serverResult
+				hr.Assertion = assertion
+			}
+		}
+
+		hr.DNSServers = append(hr.DNSServers, serverResult)
+
+	}
+
+	// The code of the first failed server decides whether the attempt is retried
+	if firstError != nil {
+		return "", newCodedError(firstError.Code, fmt.Errorf("%d of %d DNS servers failed (%s): %s", len(failedServers), len(servers), strings.Join(failedServers, ","), firstError.Error))
+	}
+
+	return strings.Join(messages, " "), nil
+
+}
+
+// assertAnswer also requires an answer if the name has to resolve
+func (c profileDNSChecker) assertAnswer(result *DNSResult) (string, error) {
+
+	assertion, err := c.dnsChecker.assertAnswer(result)
+	if err != nil {
+		return assertion, err
+	}
+
+	if c.resolve && result.RCode == dns.RcodeToString[dns.RcodeSuccess] && len(result.Answers) == 0 {
+		return "answers", newCodedError(ErrorCodeDNSAnswer, fmt.Errorf("%s %s has no answer", c.options.Name, dns.TypeToString[c.qtype]))
+	}
+
+	return "", nil
+
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const HCMethodTCP = "tcp"
+
+// tcpChecker connects to the endpoint, a host:port, and closes the connection right away
+type tcpChecker struct{}
+
+func init() {
+	registerHealthChecker(tcpChecker{})
+}
+
+func (tcpChecker) Name() string {
+	return HCMethodTCP
+}
+
+func (c tcpChecker) ParseConfig(options json.RawMessage) (HealthChecker, error) {
+	return c, parseHealthCheckOptions(options, &struct{}{})
+}
+
+func (tcpChecker) Check(ctx context.Context, target HealthCheckTarget, hr *HealthCheckResult) (string, error) {
+
+	startTime := time.Now()
+
+	dialContext, dialCancel := context.WithTimeout(ctx, target.Timeout)
+	defer dialCancel()
+
+	conn, err := target.Dialer.DialContext(dialContext, fmt.Sprintf("tcp%d", target.Family), target.Endpoint)
+	if err != nil {
+		hr.addProbes(1)
+		return "", err
+	}
+	conn.Close()
+
+	rtt := time.Since(startTime)
+	hr.addProbes(1, rtt)
+
+	return fmt.Sprintf("rtt=%dms", rtt.Milliseconds()), nil
+
+}
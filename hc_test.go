@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHealthCheckPolicy(t *testing.T) {
+
+	tests := []struct {
+		policy string
+		count  int
+		quorum int
+		err    bool // parseHealthCheckPolicy
+		unmet  bool // checkHealthCheckQuorum
+	}{
+		{policy: "all", count: 3, quorum: 3},
+		{policy: "any", count: 3, quorum: 1},
+		{policy: "quorum:1", count: 3, quorum: 1},
+		{policy: "quorum:3", count: 3, quorum: 3},
+		{policy: "quorum:4", count: 3, quorum: 4, unmet: true},
+		{policy: "quorum:2", count: 1, quorum: 2, unmet: true},
+		{policy: "quorum:0", err: true},
+		{policy: "quorum:-1", err: true},
+		{policy: "quorum:x", err: true},
+		{policy: "quorum", err: true},
+		{policy: "All", err: true},
+		{policy: "", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+
+			err := parseHealthCheckPolicy(test.policy)
+			if test.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if quorum := healthCheckQuorum(test.policy, test.count); quorum != test.quorum {
+				t.Errorf("healthCheckQuorum = %d, want %d", quorum, test.quorum)
+			}
+
+			err = checkHealthCheckQuorum(test.policy, test.count)
+			if test.unmet != (err != nil) {
+				t.Errorf("checkHealthCheckQuorum = %v, want unmet %t", err, test.unmet)
+			}
+
+		})
+	}
+
+}
+
+func TestCheckHealthChecks(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		checks []HealthCheck
+		err    string
+	}{
+		{name: "none"},
+		{name: "valid", checks: []HealthCheck{{Method: HCMethodICMP}, {Method: HCMethodTCP, Endpoint: "192.0.2.1:443", Options: []byte(`{}`)}}},
+		{name: "unknown method", checks: []HealthCheck{{Method: HCMethodICMP}, {Method: "ping"}}, err: "check #2: health check method ping is not implemented"},
+		{name: "unknown option", checks: []HealthCheck{{Name: "gw", Method: HCMethodICMP, Options: []byte(`{"count":3}`)}}, err: "check gw: icmp health check options error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			err := checkHealthChecks(test.checks)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("error = %v, want %q", err, test.err)
+			}
+
+		})
+	}
+
+}
+
+func TestInitConfigHealthCheckPolicy(t *testing.T) {
+
+	config, debugLevel := AppConfig, DebugLevel
+	defer func() {
+		AppConfig, DebugLevel = config, debugLevel
+	}()
+
+	tests := []struct {
+		name   string
+		checks string
+		policy string
+		err    string
+	}{
+		{name: "default"},
+		{name: "any", policy: "any"},
+		{name: "quorum of the checks", checks: `[{"method":"icmp"},{"method":"tcp"}]`, policy: "quorum:2"},
+		{name: "invalid policy", policy: "majority", err: "HEALTHCHECK_POLICY value error: unknown policy majority"},
+		{name: "invalid quorum", policy: "quorum:x", err: "HEALTHCHECK_POLICY value error: quorum of quorum:x is not a positive number"},
+		{name: "quorum of the method", policy: "quorum:2", err: "HEALTHCHECK_POLICY value error: quorum of quorum:2 is larger than the 1 checks"},
+		{name: "quorum larger than the checks", checks: `[{"method":"icmp"},{"method":"tcp"}]`, policy: "quorum:3", err: "HEALTHCHECK_POLICY value error: quorum of quorum:3 is larger than the 2 checks"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			AppConfig = config
+			t.Setenv("HEALTHCHECKS", test.checks)
+			t.Setenv("HEALTHCHECK_POLICY", test.policy)
+			t.Setenv("DEBUG_LEVEL", strconv.Itoa(DEBUG_SHOW_CHAOS_MESSAGE))
+
+			err := initConfig()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("error = %v, want %q", err, test.err)
+			}
+
+		})
+	}
+
+}
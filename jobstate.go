@@ -0,0 +1,164 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TeardownTimeout bounds how long a run timeout waits for jobs which are still setting up their tunnel
+const TeardownTimeout = 20 * time.Second
+
+// JobTracker knows which profiles are queued and which are running so that a run timeout
+// can report every profile and tear down the tunnels which are still up.
+var JobTracker *jobTracker
+
+type jobTracker struct {
+	mu       sync.Mutex
+	stopping bool
+	queued   map[string]bool
+	running  map[string]*runningJob
+}
+
+type runningJob struct {
+	workerNum    int
+	teardown     func()
+	teardownOnce sync.Once
+	tornDown     chan struct{} // closed when the tunnel is removed or the job finished
+	tornDownOnce sync.Once
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		queued:  make(map[string]bool),
+		running: make(map[string]*runningJob),
+	}
+}
+
+func (t *jobTracker) queue(profileId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queued[profileId] = true
+}
+
+// start moves the profile to running. false if the run is stopping and the job must not start.
+func (t *jobTracker) start(profileId string, workerNum int) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopping {
+		return false
+	}
+
+	delete(t.queued, profileId)
+	t.running[profileId] = &runningJob{workerNum: workerNum, tornDown: make(chan struct{})}
+
+	return true
+
+}
+
+// setTeardown registers how the tunnel of a running job is removed.
+// If the run is already stopping the tunnel is removed right away and false is returned.
+func (t *jobTracker) setTeardown(profileId string, teardown func()) bool {
+
+	t.mu.Lock()
+	job := t.running[profileId]
+	job.teardown = teardown
+	stopping := t.stopping
+	t.mu.Unlock()
+
+	if stopping {
+		t.teardown(profileId)
+		return false
+	}
+
+	return true
+
+}
+
+// teardown removes the tunnel of the job once, whoever calls it first
+func (t *jobTracker) teardown(profileId string) {
+
+	t.mu.Lock()
+	job := t.running[profileId]
+	t.mu.Unlock()
+
+	if job == nil || job.teardown == nil {
+		return
+	}
+
+	job.teardownOnce.Do(job.teardown)
+	job.tornDownOnce.Do(func() { close(job.tornDown) })
+
+}
+
+// finish tears down the tunnel if it is still up and forgets the job
+func (t *jobTracker) finish(profileId string) {
+
+	t.teardown(profileId)
+
+	t.mu.Lock()
+	job := t.running[profileId]
+	delete(t.running, profileId)
+	t.mu.Unlock()
+
+	if job != nil {
+		job.tornDownOnce.Do(func() { close(job.tornDown) })
+	}
+
+}
+
+// stop keeps queued jobs from starting and tears down the tunnels of running jobs.
+// It returns the queued profiles and the running profiles with their worker.
+func (t *jobTracker) stop() (queued []string, running map[string]int) {
+
+	t.mu.Lock()
+	t.stopping = true
+
+	for profileId := range t.queued {
+		queued = append(queued, profileId)
+	}
+	sort.Strings(queued)
+
+	running = make(map[string]int)
+	var teardownList []string
+	for profileId, job := range t.running {
+		running[profileId] = job.workerNum
+		if job.teardown != nil {
+			teardownList = append(teardownList, profileId)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, profileId := range teardownList {
+		t.teardown(profileId)
+	}
+
+	return queued, running
+
+}
+
+// waitTeardown waits until the tunnel of every running job is removed, up to timeout. false on timeout.
+// Jobs which were still setting up remove their tunnel as soon as the setup returns.
+func (t *jobTracker) waitTeardown(timeout time.Duration) bool {
+
+	t.mu.Lock()
+	var jobs []*runningJob
+	for _, job := range t.running {
+		jobs = append(jobs, job)
+	}
+	t.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for _, job := range jobs {
+		select {
+		case <-job.tornDown:
+		case <-deadline:
+			return false
+		}
+	}
+
+	return true
+
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobTrackerStop(t *testing.T) {
+
+	tracker := newJobTracker()
+	for _, profileId := range []string{"c", "a", "b", "d"} {
+		tracker.queue(profileId)
+	}
+
+	var tornDownB, tornDownC, tornDownD int
+	if !tracker.start("b", 1) || !tracker.setTeardown("b", func() { tornDownB++ }) {
+		t.Fatal("b did not start")
+	}
+	// c is still setting up its tunnel when the run stops
+	if !tracker.start("c", 2) {
+		t.Fatal("c did not start")
+	}
+	// d finished before the run stops
+	if !tracker.start("d", 3) || !tracker.setTeardown("d", func() { tornDownD++ }) {
+		t.Fatal("d did not start")
+	}
+	tracker.finish("d")
+
+	queued, running := tracker.stop()
+	if !reflect.DeepEqual(queued, []string{"a"}) {
+		t.Errorf("queued = %v, want [a]", queued)
+	}
+	if !reflect.DeepEqual(running, map[string]int{"b": 1, "c": 2}) {
+		t.Errorf("running = %v, want b:1 c:2", running)
+	}
+	if tornDownB != 1 {
+		t.Errorf("b torn down %d times by stop, want 1", tornDownB)
+	}
+
+	if tracker.start("a", 1) {
+		t.Error("a started after stop")
+	}
+
+	// the tunnel of c is removed as soon as its setup returns
+	if tracker.waitTeardown(10 * time.Millisecond) {
+		t.Error("waitTeardown returned true before c was torn down")
+	}
+	if tracker.setTeardown("c", func() { tornDownC++ }) {
+		t.Error("setTeardown of c returned true after stop")
+	}
+	if tornDownC != 1 {
+		t.Errorf("c torn down %d times by setTeardown, want 1", tornDownC)
+	}
+	if !tracker.waitTeardown(time.Second) {
+		t.Error("waitTeardown timed out")
+	}
+
+	// the worker finishes its jobs afterwards, which must not remove the tunnels again
+	tracker.finish("b")
+	tracker.finish("c")
+	if tornDownB != 1 || tornDownC != 1 || tornDownD != 1 {
+		t.Errorf("torn down b=%d c=%d d=%d times, want 1 each", tornDownB, tornDownC, tornDownD)
+	}
+
+}
+
+// TestJobTrackerConcurrentStop stops the run while workers start and finish jobs. Run it with -race.
+func TestJobTrackerConcurrentStop(t *testing.T) {
+
+	const workers, jobs = 8, 50
+
+	tracker := newJobTracker()
+	teardowns := make([]atomic.Int32, workers*jobs)
+	started := make([]atomic.Bool, workers*jobs)
+	for i := range teardowns {
+		tracker.queue(fmt.Sprintf("p%d", i))
+	}
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for j := 0; j < jobs; j++ {
+				i := w*jobs + j
+				profileId := fmt.Sprintf("p%d", i)
+				if !tracker.start(profileId, w) {
+					continue
+				}
+				started[i].Store(true)
+				if tracker.setTeardown(profileId, func() { teardowns[i].Add(1) }) {
+					time.Sleep(10 * time.Microsecond)
+				}
+				tracker.finish(profileId)
+			}
+		}(w)
+	}
+
+	time.Sleep(time.Millisecond)
+	queued, running := tracker.stop()
+	if !tracker.waitTeardown(5 * time.Second) {
+		t.Error("waitTeardown timed out")
+	}
+	wg.Wait()
+
+	if len(queued)+len(running) > workers*jobs {
+		t.Errorf("queued %d and running %d jobs of %d", len(queued), len(running), workers*jobs)
+	}
+	for i := range teardowns {
+		want := int32(0)
+		if started[i].Load() {
+			want = 1
+		}
+		if n := teardowns[i].Load(); n != want {
+			t.Errorf("p%d torn down %d times, want %d", i, n, want)
+		}
+	}
+
+}
@@ -1,27 +1,27 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"runtime"
-	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
-
-	"gopkg.in/ini.v1"
 )
 
 const (
@@ -44,22 +44,20 @@ var WireguardProfileFilePath = "/profile.json"
 var WireguardProfileDirectoryPath = "/etc/wireguard"
 
 type ResultMessage struct {
+	Version                   int             `json:"version"`
 	Status                    string          `json:"status"`
 	Message                   string          `json:"message"`
 	DesiredCheckCount         int             `json:"total"`
 	ProceedCount              int             `json:"proceed"`
 	ErrorCount                int             `json:"proceederror"`
 	SucceedCount              int             `json:"succeed"`
+	SkippedCount              int             `json:"skipped,omitempty"`     // not started before the run timeout or a signal
+	TimeoutCount              int             `json:"timedout,omitempty"`    // running when the run timeout occurred
+	InterruptedCount          int             `json:"interrupted,omitempty"` // running when SIGINT or SIGTERM was received
 	ActiveParallelWorkerCount int             `json:"workers"`
 	Results                   json.RawMessage `json:"results"`
 }
 
-type JobResultMessage struct {
-	Result  string `json:"result"`
-	Message string `json:"message"`
-	Label   string `json:"label,omitempty"`
-}
-
 func debugMessage(logLevel int, s string) {
 
 	if DebugLevel&logLevel != logLevel {
@@ -75,14 +73,29 @@ func debugMessage(logLevel int, s string) {
 
 var AppConfig struct {
 	HealthCheckMethod         string        // HEALTHCHECK_METHOD
+	HealthChecks              []HealthCheck // HEALTHCHECKS -- json array, replaces HEALTHCHECK_METHOD and HEALTHCHECK_ENDPOINT
+	HealthCheckPolicy         string        // HEALTHCHECK_POLICY -- all, any, quorum:N
 	HealthCheckEndpoint       string        // HEALTHCHECK_ENDPOINT
-	HealthCheckTimeout        time.Duration // HEALTHCHECK_TIMEOUT -- Fixed in dns(2000ms) icmp(800ms)
+	HealthCheckEndpoint6      string        // HEALTHCHECK_ENDPOINT6
+	HealthCheckIPFamilies     []int         // HEALTHCHECK_IP_FAMILY -- 4, 6, both
+	HealthCheckTimeout        time.Duration // HEALTHCHECK_TIMEOUT -- Fixed in icmp(800ms)
 	HealthCheckInterval       time.Duration // HEALTHCHECK_INTERVAL
 	HealthCheckRetries        int           // HEALTHCHECK_RETRIES
 	HealthCheckRunTimeout     time.Duration // HEALTHCHECK_RUNTIMEOUT
 	RunTimeout                time.Duration // RUNTIMEOUT
 	WorkerCount               int           // WORKER
 	RemoteProfilePath         string        // REMOTE_PROFILE_PATH
+	ProfileDataSingle         string        // PROFILE_DATA_SINGLE
+	ProfileIDSingle           string        // PROFILE_ID_SINGLE
+	ProfileDirectoryRecursive bool          // PROFILE_DIRECTORY_RECURSIVE
+	ProfileInclude            []string      // PROFILE_INCLUDE
+	ProfileExclude            []string      // PROFILE_EXCLUDE
+	EndpointResolver          string        // ENDPOINT_RESOLVER
+	EndpointResolvePrefer     string        // ENDPOINT_RESOLVE_PREFER -- ipv4, ipv6, ipv4only, ipv6only
+	HandshakeTimeout          time.Duration // HANDSHAKE_TIMEOUT -- 0 disables the handshake check
+	WireguardBackend          string        // WG_BACKEND -- kernel, userspace, process, netstack
+	NetworkNamespace          bool          // WG_NETNS -- a network namespace per profile
+	CleanupStale              bool          // WG_CLEANUP -- remove what a killed run left behind before starting
 	ActiveParallelWorkerCount int
 }
 
@@ -93,63 +106,124 @@ type WireguardJob struct {
 	Profile WireguardQuickConf
 }
 
-type WireguardQuickConf struct {
-	ProfileID       string // Not standrard
-	ProfileSequence int
-	Interface       struct {
-		Address           string
-		AddressCIDRPrefix uint8
-		DNS               string
-		DNSs              []string
-		PrivateKey        string
-	}
-	Peer struct {
-		AllowedIPs   string
-		AllowedIPss  []string
-		Endpoint     string
-		EndpointIP   string
-		EndpointPort string
-		PublicKey    string
-		//PresharedKey string
+var JobResultStatus map[string]ErrorSuccessResult
+
+var defaultGatewayAddress string
+var defaultGateway6Address string
+var defaultGateway6Device string
+
+// loadProfile returns the parsed profiles and, keyed by profile id, the profiles which failed to parse.
+func loadProfile() (WireguardProfileList, map[string]error, error) {
+
+	profileList := make(WireguardProfileList)
+
+	rawList, profileErrors, err := loadProfileRaw()
+	if err != nil {
+		return nil, nil, err
 	}
-}
 
-type JobResult struct {
-	ProfileID      string
-	SuccessMessage string
-	Error          error
-}
+	if profileErrors == nil {
+		profileErrors = make(map[string]error)
+	}
+
+	if len(rawList) == 0 && len(profileErrors) == 0 {
+		return nil, nil, errors.New("did not read any profile")
+	}
+
+	seq := 1
+
+	for profileId, entry := range rawList {
+
+		err = checkHealthCheckQuorum(entry.healthCheckPolicy(), len(entry.healthChecks()))
+		if err != nil {
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Profile [%s] policy error // %s", profileId, err.Error()))
+			profileErrors[profileId] = entry.entryError(fmt.Errorf("policy error: %w", err))
+			continue
+		}
+
+		err = checkHealthChecks(entry.HealthChecks)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Profile [%s] checks error // %s", profileId, err.Error()))
+			profileErrors[profileId] = entry.entryError(fmt.Errorf("checks error: %w", err))
+			continue
+		}
+
+		wgQuickConf, err := parseWireguardQuickProfile(profileId, seq, entry.Config)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Profile [%s] parse error // %s", profileId, err.Error()))
+			profileErrors[profileId] = entry.entryError(err)
+			continue
+		}
+		wgQuickConf.Settings = entry.ProfileSettings
+
+		profileList[profileId] = wgQuickConf
+		seq++
+
+	}
+
+	// Check that there are duplicate wireguard interface ip addresses? Duplicated client ips are not supported
+	visitedInterfaceIPAddress := make(map[string]bool)
+	for _, v := range profileList {
+		if _, ok := visitedInterfaceIPAddress[v.Interface.Address]; ok {
+			// var resultMessage ResultMessage
+			// resultMessage.Status = "error"
+			// resultMessage.Message = fmt.Sprintf("Conflicts Interface Address = %s", v.Interface.Address)
+			// j, err := json.Marshal(resultMessage)
+			// if err != nil {
+			// 	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
+			// } else {
+			// 	fmt.Println(string(j))
+			// }
+			// os.Exit(1)
+			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Conflicts Interface Address = %s", v.Interface.Address))
+		} else {
+			visitedInterfaceIPAddress[v.Interface.Address] = true
+		}
+	}
+
+	return profileList, profileErrors, nil
 
-type ErrorSuccessResult struct {
-	Success      string `json:"status"`
-	ErrorMessage string `json:"message"`
 }
 
-var JobResultStatus map[string]ErrorSuccessResult
+// loadProfileRaw reads base64 encoded wg-quick profiles from the first available source.
+// Precedence: PROFILE_DATA_SINGLE > REMOTE_PROFILE_PATH > /profile.json > /etc/wireguard
+// profileErrors holds the profiles that could not be read at all. (directory source only)
+func loadProfileRaw() (rawList WireguardProfileListRaw, profileErrors map[string]error, err error) {
 
-var defaultGatewayAddress string
+	if AppConfig.ProfileDataSingle != "" {
 
-func loadProfile() (WireguardProfileList, error) {
+		debugMessage(DEBUG_SHOW_INFO_MESSAGE, "Read profile from PROFILE_DATA_SINGLE")
 
-	profileList := make(WireguardProfileList)
-	var rawList WireguardProfileListRaw
+		profileData := strings.Join(strings.Fields(AppConfig.ProfileDataSingle), "")
+
+		profileId := AppConfig.ProfileIDSingle
+		if profileId == "" {
+			profileId = deriveSingleProfileID(profileData)
+		}
+
+		rawList = WireguardProfileListRaw{profileId: {Config: profileData}}
 
-	if AppConfig.RemoteProfilePath != "" {
+	} else if AppConfig.RemoteProfilePath != "" {
 
 		debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Get profile from %s", AppConfig.RemoteProfilePath))
 
 		resp, err := http.Get(AppConfig.RemoteProfilePath)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != 200 {
-			return nil, errors.New("the response of profile request has not returned 200")
+			return nil, nil, errors.New("the response of profile request has not returned 200")
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		err = json.NewDecoder(resp.Body).Decode(&rawList)
+		rawList, profileErrors, err = decodeProfileList(data)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 	} else {
@@ -158,166 +232,137 @@ func loadProfile() (WireguardProfileList, error) {
 		data, err := ioutil.ReadFile(WireguardProfileFilePath)
 		if err == nil {
 
-			err = json.Unmarshal(data, &rawList)
+			rawList, profileErrors, err = decodeProfileList(data)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 
 			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, string(data))
 
 		} else {
 
-			rawList = make(WireguardProfileListRaw)
-
-			debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Try read from %s", WireguardProfileDirectoryPath))
-			readdir, err := ioutil.ReadDir(WireguardProfileDirectoryPath)
+			rawList, profileErrors, err = loadProfileDirectory(WireguardProfileDirectoryPath)
 			if err != nil {
-				debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Cannot read %s // %s", WireguardProfileFilePath, err.Error()))
-				return nil, err
+				debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Cannot read %s // %s", WireguardProfileDirectoryPath, err.Error()))
+				return nil, nil, err
 			}
+		}
 
-			for _, file := range readdir {
+	}
 
-				if !file.IsDir() && strings.HasSuffix(file.Name(), ".conf") {
-					profileId := strings.TrimSuffix(file.Name(), ".conf")
-					if profileId == "" {
-						return nil, errors.New("read .conf")
-					}
+	return rawList, profileErrors, nil
 
-					readData, err := ioutil.ReadFile(file.Name())
-					if err != nil {
-						debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Cannot read %s // %s", file.Name(), err.Error()))
-						continue
-					}
+}
 
-					rawList[profileId] = base64.StdEncoding.EncodeToString(readData)
+// loadProfileDirectory reads every *.conf under dir as a profile keyed by its filename.
+// Files which cannot be read are reported in profileErrors instead of aborting the whole run.
+func loadProfileDirectory(dir string) (rawList WireguardProfileListRaw, profileErrors map[string]error, err error) {
 
-				}
+	rawList = make(WireguardProfileListRaw)
+	profileErrors = make(map[string]error)
+	profilePath := make(map[string]string)
 
-			}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 
-			return nil, err
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Cannot read %s // %s", path, err.Error()))
+			return nil
 		}
 
-	}
-
-	if len(rawList) == 0 {
-		return nil, errors.New("did not read any profile")
-	}
-
-	seq := 1
-
-	for profileId, base64EncodedWireguardQuickProfile := range rawList {
-
-		if len(profileId)+len(WireguardInterfacePrefix) > 15 {
-			panic(fmt.Sprintf("ifname [%s%s] is too long", profileId, WireguardInterfacePrefix))
+		if d.IsDir() {
+			if path != dir && !AppConfig.ProfileDirectoryRecursive {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
-		decodeArray, err := base64.StdEncoding.DecodeString(base64EncodedWireguardQuickProfile)
-		if err != nil {
-			return nil, err
+		if !strings.HasSuffix(d.Name(), ".conf") {
+			return nil
 		}
 
-		cfg, err := ini.Load([]byte(decodeArray))
+		relPath, err := filepath.Rel(dir, path)
 		if err != nil {
-			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, string(debug.Stack()))
-			return nil, err
+			relPath = d.Name()
 		}
 
-		_, err = cfg.GetSection("Interface")
-		if err != nil {
-			return nil, err
+		if !matchProfileFile(relPath) {
+			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Skip %s by include/exclude filter", relPath))
+			return nil
 		}
 
-		var wgQuickConf WireguardQuickConf
-		wgQuickConf.ProfileID = profileId
-		wgQuickConf.ProfileSequence = seq
-		profileIPAddress := cfg.Section("Interface").Key("Address").String()
+		// A file which does not give a profile of its own is reported by its path, so that it never replaces the result of a profile
+		fileKey := "file:" + filepath.ToSlash(relPath)
 
-		netIP, _, err := net.ParseCIDR(profileIPAddress)
-		if err == nil {
-			wgQuickConf.Interface.Address = netIP.String()
-		} else {
-			if netIP := net.ParseIP(profileIPAddress); netIP != nil {
-				wgQuickConf.Interface.Address = netIP.String()
-			} else {
-				panic(fmt.Sprintf("Profile [%s] IP address [%s] is invalid", profileId, profileIPAddress))
-			}
+		profileId := strings.TrimSuffix(d.Name(), ".conf")
+		if profileId == "" {
+			profileErrors[fileKey] = fmt.Errorf("%s: profile id is empty", relPath)
+			return nil
 		}
 
-		wgQuickConf.Interface.DNS = cfg.Section("Interface").Key("DNS").String()
-
-		wgQuickConf.Interface.DNSs = strings.Split(wgQuickConf.Interface.DNS, ",")
-		for i := range wgQuickConf.Interface.DNSs {
-			wgQuickConf.Interface.DNSs[i] = strings.TrimSpace(wgQuickConf.Interface.DNSs[i])
+		if prevPath, ok := profilePath[profileId]; ok {
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Duplicated profile id [%s] %s, %s", profileId, prevPath, relPath))
+			profileErrors[fileKey] = fmt.Errorf("%s: duplicated profile id [%s] with %s", relPath, profileId, prevPath)
+			return nil
 		}
-		wgQuickConf.Interface.DNS = wgQuickConf.Interface.DNSs[0]
+		profilePath[profileId] = relPath
 
-		wgQuickConf.Interface.PrivateKey, err = convertWireguardQuickConfigurationKeyHexEncoding(cfg.Section("Interface").Key("PrivateKey").String())
+		readData, err := ioutil.ReadFile(path)
 		if err != nil {
-			return nil, err
+			debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Cannot read %s // %s", path, err.Error()))
+			profileErrors[profileId] = fmt.Errorf("%s: %w", relPath, err)
+			return nil
 		}
 
-		wgQuickConf.Peer.AllowedIPs = cfg.Section("Peer").Key("AllowedIPs").String()
-		// TODO: AllowedIPs no defualt route
-		wgQuickConf.Peer.AllowedIPss = strings.Split(wgQuickConf.Peer.AllowedIPs, ",")
-		for i := range wgQuickConf.Peer.AllowedIPss {
-			wgQuickConf.Peer.AllowedIPss[i] = strings.TrimSpace(wgQuickConf.Peer.AllowedIPss[i])
-		}
-		wgQuickConf.Peer.AllowedIPs = wgQuickConf.Peer.AllowedIPss[0]
+		rawList[profileId] = WireguardProfileEntry{Config: base64.StdEncoding.EncodeToString(readData)}
 
-		wgQuickConf.Peer.Endpoint = cfg.Section("Peer").Key("Endpoint").String()
+		return nil
 
-		splitEndpoint := strings.Split(wgQuickConf.Peer.Endpoint, ":")
-		wgQuickConf.Peer.EndpointIP = splitEndpoint[0]
-		wgQuickConf.Peer.EndpointPort = splitEndpoint[1]
+	})
 
-		wgQuickConf.Peer.PublicKey, err = convertWireguardQuickConfigurationKeyHexEncoding(cfg.Section("Peer").Key("PublicKey").String())
-		if err != nil {
-			return nil, err
-		}
+	return rawList, profileErrors, err
 
-		profileList[profileId] = wgQuickConf
-		seq++
+}
 
-	}
+// matchProfileFile applies PROFILE_INCLUDE and PROFILE_EXCLUDE globs to a path relative to the profile directory.
+// A pattern without a slash is matched against the filename only.
+func matchProfileFile(relPath string) bool {
 
-	// Check that there are duplicate wireguard interface ip addresses? Duplicated client ips are not supported
-	visitedInterfaceIPAddress := make(map[string]bool)
-	for _, v := range profileList {
-		if _, ok := visitedInterfaceIPAddress[v.Interface.Address]; ok {
-			// var resultMessage ResultMessage
-			// resultMessage.Status = "error"
-			// resultMessage.Message = fmt.Sprintf("Conflicts Interface Address = %s", v.Interface.Address)
-			// j, err := json.Marshal(resultMessage)
-			// if err != nil {
-			// 	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
-			// } else {
-			// 	fmt.Println(string(j))
-			// }
-			// os.Exit(1)
-			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Conflicts Interface Address = %s", v.Interface.Address))
-		} else {
-			visitedInterfaceIPAddress[v.Interface.Address] = true
+	match := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			name := relPath
+			if !strings.Contains(pattern, "/") {
+				name = filepath.Base(relPath)
+			}
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
 		}
+		return false
 	}
 
-	return profileList, nil
+	if len(AppConfig.ProfileInclude) > 0 && !match(AppConfig.ProfileInclude) {
+		return false
+	}
 
-}
+	if match(AppConfig.ProfileExclude) {
+		return false
+	}
 
-func convertWireguardQuickConfigurationKeyHexEncoding(s string) (string, error) {
+	return true
 
-	decodeKey, err := base64.StdEncoding.DecodeString(s)
-	if err != nil {
-		return "", err
-	}
+}
 
-	hexString := hex.EncodeToString(decodeKey)
-	return hexString, nil
+// deriveSingleProfileID makes a stable profile id from the value of PROFILE_DATA_SINGLE.
+// The value is hashed as it is, so that a value which is not valid base64 still gets an id and is reported as PROFILE_PARSE.
+func deriveSingleProfileID(profileData string) string {
+	sum := sha256.Sum256([]byte(profileData))
+	return fmt.Sprintf("single_%s", hex.EncodeToString(sum[:2]))
 }
 
-func startWorker(processCh chan JobResult, wireguardProfileList WireguardProfileList) {
+func startWorker(ctx context.Context, processCh chan JobResult, wireguardProfileList WireguardProfileList) {
 
 	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "Partitioning worker")
 
@@ -333,60 +378,28 @@ func startWorker(processCh chan JobResult, wireguardProfileList WireguardProfile
 		workerPartition := (i % AppConfig.WorkerCount) + 1
 		wireguardProfile := profileList[i]
 
-		assigned := false
-
-	WorkerSetting1:
-
-		// full scan to find duplicate EndpointIP
+		// Conflicting profiles have to run one after another on one worker, see conflictsWith.
+		// Workers which the profile links are merged into one.
+		var conflicts []int
 		for k, _ := range WireguardWorkersJob {
-			if WireguardWorkersJob[k] != nil {
-
-				if _, ok := WireguardWorkersJob[k][wireguardProfile.Peer.EndpointIP]; ok {
-					debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Duplicated endpoint ip [%s] detected.\n", wireguardProfile.Peer.EndpointIP))
-					WireguardWorkersJob[k][wireguardProfile.Peer.EndpointIP] = append(WireguardWorkersJob[k][wireguardProfile.Peer.EndpointIP], WireguardJob{Profile: wireguardProfile})
-					debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Assigned Profile [%s] to Worker[%d]\n", wireguardProfile.ProfileID, k))
-					assigned = true
-					break WorkerSetting1
-				}
+			if conflictsWithWorkerJob(WireguardWorkersJob[k], wireguardProfile) {
+				conflicts = append(conflicts, k)
 			}
 		}
 
-		if assigned {
-			continue
-		}
-
-	WorkerSetting2:
-		// full scan to find duplicate InterfaceIP
-		for k, _ := range WireguardWorkersJob {
-			if WireguardWorkersJob[k] != nil {
-				workerJobList, ok := WireguardWorkersJob[k]
-				if ok {
-					for _, jobList := range workerJobList {
-						for _, job := range jobList {
-							if job.Profile.Interface.Address == wireguardProfile.Interface.Address {
-								debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Conflicts interface ip [%s]\n", wireguardProfile.Interface.Address))
-								WireguardWorkersJob[k][wireguardProfile.Peer.EndpointIP] = append(WireguardWorkersJob[k][wireguardProfile.Peer.EndpointIP], WireguardJob{Profile: wireguardProfile})
-								debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Assigned Profile [%s] to Worker[%d]\n", wireguardProfile.ProfileID, k))
-								assigned = true
-								break WorkerSetting2
-							}
-						}
-					}
+		if len(conflicts) > 0 {
+			sort.Ints(conflicts)
+			for _, k := range conflicts[1:] {
+				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Merge Worker[%d] into Worker[%d] for profile [%s]\n", k, conflicts[0], wireguardProfile.ProfileID))
+				for endpointIP, jobList := range WireguardWorkersJob[k] {
+					WireguardWorkersJob[conflicts[0]][endpointIP] = append(WireguardWorkersJob[conflicts[0]][endpointIP], jobList...)
 				}
+				delete(WireguardWorkersJob, k)
 			}
+			workerPartition = conflicts[0]
 		}
 
-		if assigned {
-			continue
-		}
-
-		if WireguardWorkersJob[workerPartition] == nil {
-			WireguardWorkersJob[workerPartition] = make(WireguardJobList)
-		}
-
-		WireguardWorkersJob[workerPartition][wireguardProfile.Peer.EndpointIP] = append(WireguardWorkersJob[workerPartition][wireguardProfile.Peer.EndpointIP], WireguardJob{Profile: wireguardProfile})
-
-		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Assigned Profile [%s] to Worker[%d]\n", wireguardProfile.ProfileID, workerPartition))
+		assignWorkerJob(workerPartition, wireguardProfile)
 
 	}
 
@@ -406,7 +419,7 @@ func startWorker(processCh chan JobResult, wireguardProfileList WireguardProfile
 		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Start Worker #%d", workerNum))
 		wg.Add(1)
 		AppConfig.ActiveParallelWorkerCount++
-		go workerRun(wg, workerNum, processCh, workerJobList)
+		go workerRun(ctx, wg, workerNum, processCh, workerJobList)
 
 	}
 	wg.Wait()
@@ -415,7 +428,35 @@ func startWorker(processCh chan JobResult, wireguardProfileList WireguardProfile
 
 }
 
-func workerRun(wg *sync.WaitGroup, workerNum int, processCh chan JobResult, wgJobList WireguardJobList) {
+// conflictsWithWorkerJob reports whether the profile conflicts with a job of the worker
+func conflictsWithWorkerJob(workerJobList WireguardJobList, wireguardProfile WireguardQuickConf) bool {
+
+	for _, jobList := range workerJobList {
+		for _, job := range jobList {
+			if reason := job.Profile.conflictsWith(wireguardProfile, usesHostNetwork()); reason != "" {
+				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Profiles [%s] and [%s] conflict // %s\n", job.Profile.ProfileID, wireguardProfile.ProfileID, reason))
+				return true
+			}
+		}
+	}
+
+	return false
+
+}
+
+func assignWorkerJob(workerNum int, wireguardProfile WireguardQuickConf) {
+
+	if WireguardWorkersJob[workerNum] == nil {
+		WireguardWorkersJob[workerNum] = make(WireguardJobList)
+	}
+
+	WireguardWorkersJob[workerNum][wireguardProfile.EndpointIP()] = append(WireguardWorkersJob[workerNum][wireguardProfile.EndpointIP()], WireguardJob{Profile: wireguardProfile})
+
+	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Assigned Profile [%s] to Worker[%d]\n", wireguardProfile.ProfileID, workerNum))
+
+}
+
+func workerRun(ctx context.Context, wg *sync.WaitGroup, workerNum int, processCh chan JobResult, wgJobList WireguardJobList) {
 	defer wg.Done()
 	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Running wireguard worker#%d", workerNum))
 
@@ -424,48 +465,103 @@ func workerRun(wg *sync.WaitGroup, workerNum int, processCh chan JobResult, wgJo
 		for i, subJob := range wgJobList[endpointIPAddress] {
 			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Run wireguard profile [%s]", subJob.Profile.ProfileID))
 
-			var rtId int
+			profileId := subJob.Profile.ProfileID
+			if !JobTracker.start(profileId, workerNum) {
+				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Skip wireguard profile [%s] // run is stopping", profileId))
+				continue
+			}
+
+			var timing JobTiming
+			profile := subJob.Profile
+
+			network := newNetworkSetup(fmt.Sprintf("%s%s", WireguardInterfacePrefix, profileId))
 
-			pid, err := wireguard(i, workerNum, subJob, &rtId)
+			// Cancelled when the job is done, so that nothing of the job outlives its teardown
+			jobContext, cancelJob := context.WithCancel(ctx)
+
+			startTime := time.Now()
+			tunnel, handshakeLatency, err := wireguard(jobContext, i, workerNum, subJob, network)
+			timing.Handshake = handshakeLatency
+			timing.TunnelUp = time.Since(startTime) - handshakeLatency
+			backend := ""
+			if tunnel != nil {
+				backend = tunnel.Backend()
+			}
 			if DebugLevel&DEBUG_DO_NOT_STOP == DEBUG_DO_NOT_STOP {
+				cancelJob()
+				JobTracker.finish(profileId)
 				continue
 			}
 
-			if err != nil {
-				proc, errProcess := os.FindProcess(pid)
-				if errProcess == nil {
-					debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("killing wireguard %d", pid))
-					proc.Kill()
+			running := JobTracker.setTeardown(profileId, func() {
+				if err := network.Rollback(); err != nil {
+					debugMessage(DEBUG_SHOW_CHAOS_MESSAGE, fmt.Sprintf("[%s] %s", profileId, err.Error()))
+				}
+				if tunnel != nil {
+					tunnel.Close()
 				}
+			})
+			if !running {
+				// torn down by the run timeout, which reports the profile itself
+				cancelJob()
+				JobTracker.finish(profileId)
+				continue
+			}
 
-				cleanWireguard(i, workerNum, subJob, &rtId)
+			if err != nil {
+				cancelJob()
+				tunnelResult := collectTunnelResult(tunnel)
+
+				startTime = time.Now()
+				JobTracker.teardown(profileId)
+				timing.Teardown = time.Since(startTime)
+				JobTracker.finish(profileId)
+
+				code := errorCode(err)
+				if code == "" {
+					code = ErrorCodeTunnelStart
+				}
 
 				processCh <- JobResult{
-					ProfileID: subJob.Profile.ProfileID,
-					Error:     err,
+					ProfileID:         profileId,
+					WorkerID:          workerNum,
+					Backend:           backend,
+					Profile:           &profile,
+					Error:             err,
+					ErrorCode:         code,
+					ResolvedEndpoints: subJob.Profile.ResolvedEndpoints(),
+					Timing:            timing,
+					Tunnel:            tunnelResult,
 				}
 
 				continue
 			}
 
-			hr := healthCheck(i, workerNum, subJob)
-			if hr.Error != nil {
-				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, hr.Error.Error())
+			startTime = time.Now()
+			checks := healthCheck(jobContext, i, workerNum, subJob, tunnel, network)
+			timing.Check = time.Since(startTime)
+			cancelJob()
+			for _, check := range checks {
+				if check.Error != nil {
+					debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, check.Error.Error())
+				}
 			}
 
-			proc, errProcess := os.FindProcess(pid)
-			if errProcess == nil {
-				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("killing wireguard %d", pid))
-				proc.Kill()
-			}
+			tunnelResult := collectTunnelResult(tunnel)
 
-			cleanWireguard(i, workerNum, subJob, &rtId)
+			startTime = time.Now()
+			JobTracker.teardown(profileId)
+			timing.Teardown = time.Since(startTime)
+			JobTracker.finish(profileId)
 
-			processCh <- JobResult{
-				ProfileID:      subJob.Profile.ProfileID,
-				SuccessMessage: hr.SuccessMessage,
-				Error:          hr.Error,
-			}
+			jobResult := newJobResult(profileId, checks, profile.Settings.healthCheckPolicy())
+			jobResult.WorkerID = workerNum
+			jobResult.Backend = backend
+			jobResult.Profile = &profile
+			jobResult.ResolvedEndpoints = subJob.Profile.ResolvedEndpoints()
+			jobResult.Timing = timing
+			jobResult.Tunnel = tunnelResult
+			processCh <- jobResult
 
 		}
 
@@ -475,324 +571,216 @@ func workerRun(wg *sync.WaitGroup, workerNum int, processCh chan JobResult, wgJo
 
 }
 
-func wireguard(subJobSequence int, workerNum int, wgJob WireguardJob, routerTableId *int) (pid int, err error) {
-	wireguardCh := make(chan error)
-	wireguardSock := make(chan net.Conn)
+func wireguard(ctx context.Context, subJobSequence int, workerNum int, wgJob WireguardJob, network *NetworkSetup) (tunnel WireguardTunnel, handshakeLatency time.Duration, err error) {
 
 	wireguardInterfaceName := fmt.Sprintf("%s%s", WireguardInterfacePrefix, wgJob.Profile.ProfileID)
 
-	go func() {
-		cmd := exec.Command("/bin/wireguard-go", "-f", wireguardInterfaceName)
-		cmd.Env = os.Environ()
-		cmd.Env = append(cmd.Env, "LOG_LEVEL=debug")
-		stdout, _ := cmd.StdoutPipe()
-		stderr, _ := cmd.StderrPipe()
-		cmd.Start()
-		pid = cmd.Process.Pid
-
-		stdoutScanner := bufio.NewScanner(stdout)
-		stderrScanner := bufio.NewScanner(stderr)
-		stdoutScanner.Split(bufio.ScanLines)
-		stderrScanner.Split(bufio.ScanLines)
-
-		for {
-			scanOut := stdoutScanner.Scan()
-			scanErr := stderrScanner.Scan()
-
-			flag := false
-
-			if scanOut {
-				debugMessage(DEBUG_SHOW_WIREGUARD_MESSAGE, stdoutScanner.Text())
-				flag = true
-			}
-
-			if scanErr {
-				debugMessage(DEBUG_SHOW_WIREGUARD_MESSAGE, stderrScanner.Text())
-				flag = true
-			}
-
-			if !flag {
-				break
-			}
-
-		}
-		err := cmd.Wait()
-		if err != nil {
-			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
-		}
-
-	}()
-
-	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "Waiting for wireguard running up")
-
-	go func() {
-		// Check wireguard socket avaialble
-
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	Timeout:
-		for {
-			select {
-			case <-ctx.Done():
-				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "Timeout!!!!!!!!!!!!!")
-				wireguardCh <- errors.New("context timeout")
-				break Timeout
-			default:
-				conn, err := net.Dial("unix", fmt.Sprintf("/var/run/wireguard/%s.sock", wireguardInterfaceName))
-				if err == nil {
-					wireguardCh <- nil
-					wireguardSock <- conn
-					break Timeout
-				}
-				time.Sleep(50 * time.Millisecond)
-			}
-
-		}
-	}()
-
-	err = <-wireguardCh
+	tunnel, err = startWireguardTunnel(ctx, wireguardInterfaceName, wgJob.Profile)
 	if err != nil {
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
+		err = newCodedError(ErrorCodeTunnelStart, err)
 		return
 	}
-	sock := <-wireguardSock
+
 	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "wireguard is setting up now")
 	// Setup Wireguard
-	wgSetupCommand := ""
-	wgSetupCommand += "set=1\n"
-	wgSetupCommand += fmt.Sprintf("private_key=%s\n", wgJob.Profile.Interface.PrivateKey)
-	wgSetupCommand += fmt.Sprintf("fwmark=%d\n", wgJob.Profile.ProfileSequence)
-	wgSetupCommand += fmt.Sprintf("public_key=%s\n", wgJob.Profile.Peer.PublicKey)
-	wgSetupCommand += fmt.Sprintf("allowed_ip=%s\n", wgJob.Profile.Peer.AllowedIPs)
-	wgSetupCommand += fmt.Sprintf("endpoint=%s\n", wgJob.Profile.Peer.Endpoint)
-	wgSetupCommand += "\n"
-	wgSetupCommand += "get=1\n"
-
-	_, err = sock.Write([]byte(wgSetupCommand))
+	// fwmark needs CAP_NET_ADMIN, so netstack tunnels only set the one of the profile
+	defaultFwMark := 0
+	if usesHostNetwork() {
+		defaultFwMark = wgJob.Profile.ProfileSequence
+	}
+	wgSetupCommand := wgJob.Profile.uapiSetCommand(defaultFwMark)
+
+	err = tunnel.IpcSet(wgSetupCommand)
 	if err != nil {
 		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
+		err = newCodedError(ErrorCodeUAPI, err)
 		return
 	}
 
-	recvData := make([]byte, 512)
-	n, err := sock.Read(recvData)
-	if n > 0 {
-		// do something with recvData[:n]
-		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("got data %s", recvData[:n]))
-
-		splitRows := strings.Split(string(recvData[:n]), "\n")
+	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "ok")
 
-		flag := false
-		for _, v := range splitRows {
-			if strings.HasPrefix(v, "errno=") {
-				if v != "errno=0" {
-					flag = true
-				}
-			}
+	if hasTunnelInterface() {
+		err = network.Setup(wgJob.Profile)
+		if t, ok := tunnel.(namespacedTunnel); ok && network.Namespace != nil {
+			t.setNamespace(network.Namespace)
 		}
-
-		if flag {
-			err = errors.New("wireguard got error")
+		if err != nil {
+			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
+			err = newCodedError(ErrorCodeRouteSetup, err)
 			return
 		}
-
 	}
-	if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
-		// handle timeout
-		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "sock timeout")
-		return
-	} else if err != nil {
-		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "sock error")
-		return
-	}
-
-	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "ok")
-
-	// Tunnel Setup
-
-	var intSetupCommand []string
-	intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip addr add %s/32 dev %s", wgJob.Profile.Interface.Address, wireguardInterfaceName))
-	intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip link set %s up", wireguardInterfaceName))
-
-	if subJobSequence == 0 {
-		intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip route add %s/32 via %s metric 1", wgJob.Profile.Peer.EndpointIP, defaultGatewayAddress))
-		// intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip route add %s via %s metric 1", wgJob.Profile.Peer.EndpointIP, defaultGatewayAddress))
-	}
-
-	*routerTableId = (wgJob.Profile.ProfileSequence + 1000)
-
-	intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip route add default via %s dev %s table %d", wgJob.Profile.Interface.Address, wireguardInterfaceName, (*routerTableId)))
-	intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip rule add from %s/32 table %d", wgJob.Profile.Interface.Address, (*routerTableId)))
-
-	for _, command := range intSetupCommand {
-
-		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, command)
 
-		commandSplit := strings.Split(command, " ")
-		commandPath := commandSplit[0]
-		commandArgs := commandSplit[1:]
-
-		cmd := exec.Command(commandPath, commandArgs...)
-		var outb, errb bytes.Buffer
-		cmd.Stdout = &outb
-		cmd.Stderr = &errb
-		if err = cmd.Run(); err != nil {
-			fmt.Fprintf(os.Stderr, "out: %s", outb.String())
-			fmt.Fprintf(os.Stderr, "err: %s", errb.String())
-			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
-			return
-		} else {
-			if outb.Available() > 0 {
-				buf := outb.String()
-				if len(buf) > 0 && buf != "<nil>" {
-					debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, buf)
-				}
+	if handshakeTimeout := wgJob.Profile.Settings.handshakeTimeout(); handshakeTimeout > 0 {
+		handshakeLatency, err = waitHandshake(ctx, tunnel, wgJob.Profile, handshakeTimeout)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("[%s] %s", wgJob.Profile.ProfileID, err.Error()))
+			if errorCode(err) == "" {
+				err = newCodedError(ErrorCodeUAPI, err)
 			}
+			return
 		}
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("[%s] handshake completed in %dms", wgJob.Profile.ProfileID, handshakeLatency.Milliseconds()))
 	}
 
 	return
 
 }
 
-// shit
-func cleanWireguard(subJobSequence int, workerNum int, wgJob WireguardJob, routerTableId *int) {
+// healthCheck runs every check of the profile, or HEALTHCHECKS, through the same tunnel once per ip family in HEALTHCHECK_IP_FAMILY
+func healthCheck(ctx context.Context, subJobSequence int, workerNum int, wgJob WireguardJob, tunnel WireguardTunnel, network *NetworkSetup) []*CheckResult {
 
-	var intSetupCommand []string
+	var results []*CheckResult
 
-	wireguardInterfaceName := fmt.Sprintf("%s%s", WireguardInterfacePrefix, wgJob.Profile.ProfileID)
-
-	intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip addr delete %s/32 dev %s", wgJob.Profile.Interface.Address, wireguardInterfaceName))
-	intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip link delete %s", wireguardInterfaceName))
+	settings := wgJob.Profile.Settings
 
-	intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip route add %s/32 via %s metric 1", wgJob.Profile.Peer.EndpointIP, defaultGatewayAddress))
+	for _, check := range settings.healthChecks() {
 
-	if routerTableId != nil {
-		intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip route delete default via %s dev %s table %d", wgJob.Profile.Interface.Address, wireguardInterfaceName, (*routerTableId)))
-		intSetupCommand = append(intSetupCommand, fmt.Sprintf("ip rule delete from %s/32 table %d", wgJob.Profile.Interface.Address, (*routerTableId)))
-	}
+		var hrs []*HealthCheckResult
 
-	for _, command := range intSetupCommand {
+		checker, checkerErr := newHealthChecker(check.Method, check.Options)
 
-		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, command)
+		for _, family := range AppConfig.HealthCheckIPFamilies {
 
-		commandSplit := strings.Split(command, " ")
-		commandPath := commandSplit[0]
-		commandArgs := commandSplit[1:]
+			var hr *HealthCheckResult
+			sourceAddress := wgJob.Profile.InterfaceAddress(family)
+			endpoint := check.endpoint(family)
 
-		cmd := exec.Command(commandPath, commandArgs...)
-		var outb, errb bytes.Buffer
-		cmd.Stdout = &outb
-		cmd.Stderr = &errb
-		if err := cmd.Run(); err != nil {
-			debugMessage(DEBUG_SHOW_CHAOS_MESSAGE, fmt.Sprintf("[ERROR] %s", command))
-			debugMessage(DEBUG_SHOW_CHAOS_MESSAGE, fmt.Sprintf("out: %s", outb.String()))
-			debugMessage(DEBUG_SHOW_CHAOS_MESSAGE, fmt.Sprintf("err: %s", errb.String()))
-			debugMessage(DEBUG_SHOW_CHAOS_MESSAGE, err.Error())
-		} else {
-			if outb.Available() > 0 {
-				buf := outb.String()
-				if len(buf) > 0 && buf != "<nil>" {
-					debugMessage(DEBUG_SHOW_CHAOS_MESSAGE, buf)
-				}
+			if sourceAddress == "" {
+				hr = newHealthCheckResult(check.Method, "", endpoint)
+				hr.fail(ErrorCodeCheckError, fmt.Errorf("[Worker#%d,Subjob#%d] profile has no IPv%d interface address", workerNum, subJobSequence, family))
+			} else if checkerErr != nil {
+				hr = newHealthCheckResult(check.Method, sourceAddress, endpoint)
+				hr.fail(ErrorCodeCheckError, checkerErr)
+			} else {
+				hr = runHealthCheck(ctx, checker, HealthCheckTarget{
+					Family:        family,
+					SourceAddress: sourceAddress,
+					Endpoint:      endpoint,
+					DNSServers:    wgJob.Profile.Interface.DNSs,
+					Dialer:        tunnelDialer(tunnel, network, sourceAddress),
+					Timeout:       settings.healthCheckTimeout(),
+					RunTimeout:    settings.healthCheckRunTimeout(),
+					Description:   fmt.Sprintf("[Worker#%d,Subjob#%d,%s,%s/%s] ", workerNum, subJobSequence, sourceAddress, endpoint, checker.Name()),
+				})
 			}
-		}
-	}
 
-}
+			hr.Family = family
+			hrs = append(hrs, hr)
 
-func healthCheck(subJobSequence int, workerNum int, wgJob WireguardJob) *HealthCheckResult {
+		}
+
+		results = append(results, newCheckResult(check.Name, check.Method, hrs))
 
-	switch AppConfig.HealthCheckMethod {
-	case HCMethodICMP:
-		return healthCheckICMP(subJobSequence, workerNum, wgJob)
-	case HCMethodDNS:
-		return healthCheckDNS(subJobSequence, workerNum, wgJob)
-	case HCMethodTCP:
-		return healthCheckTCP(subJobSequence, workerNum, wgJob)
-	case HCMethodHTTP:
-		return healthCheckHTTP(subJobSequence, workerNum, wgJob)
-	default:
-		return &HealthCheckResult{Error: errors.New("Not implemented healthcheck method")}
 	}
 
+	return results
+
 }
 
-type WireguardProfileListRaw map[string]string // profile id = b64
+type WireguardProfileListRaw map[string]WireguardProfileEntry // key=profile id
 type WireguardProfileList map[string]WireguardQuickConf
 
-const (
-	HCMethodICMP = "icmp"
-	HCMethodDNS  = "dns"
-	HCMethodTCP  = "tcp"
-	HCMethodHTTP = "http"
-)
-
 func main() {
 
-	initConfig()
+	err := initConfig()
+	if err != nil {
+		exitWithError(err)
+	}
 
-	profileList, err := loadProfile()
+	profileList, profileErrors, err := loadProfile()
 	if err != nil {
 		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
 		os.Exit(1)
 	}
 
+	// Tunnels are torn down before exit on SIGINT and SIGTERM
+	chSignal := make(chan os.Signal, 1)
+	signal.Notify(chSignal, syscall.SIGINT, syscall.SIGTERM)
+
+	// The root context of the run. Cancelling it aborts the tunnels and health checks of every worker.
+	runContext, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+
+	// RUNTIMEOUT starts before the endpoints are resolved, so that dead names cannot hold the run
+	timeoutContext, cancel := context.WithTimeout(runContext, AppConfig.RunTimeout)
+	defer cancel()
+
+	// A signal while resolving stops the resolution and is handed on to the collect loop below
+	resolveContext, cancelResolve := context.WithCancel(timeoutContext)
+	resolveDone := make(chan struct{})
+	go func() {
+		defer close(resolveDone)
+		select {
+		case sig := <-chSignal:
+			cancelResolve()
+			select {
+			case chSignal <- sig:
+			default:
+			}
+		case <-resolveContext.Done():
+		}
+	}()
+
+	resolveProfileEndpoints(resolveContext, profileList, profileErrors)
+	stopped := resolveContext.Err() != nil
+	cancelResolve()
+	<-resolveDone
+
+	// Opt-in, because another instance in the same network namespace cannot be told from a killed run
+	if AppConfig.CleanupStale && hasTunnelInterface() && !stopped {
+		reconcileNetwork()
+	}
+
 	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Load %d Profile\n", len(profileList)))
 
-	chJobResult := make(chan JobResult)
+	// Buffered so that workers never block on a result which is not collected after a run timeout
+	chJobResult := make(chan JobResult, len(profileList))
 
-	go startWorker(chJobResult, profileList)
+	for profileId := range profileList {
+		JobTracker.queue(profileId)
+	}
 
-	timeoutContext, _ := context.WithTimeout(context.Background(), AppConfig.RunTimeout)
+	// A run which was stopped while resolving reports every profile as skipped without starting a worker
+	if !stopped {
+		go startWorker(runContext, chJobResult, profileList)
+	}
 
 	// Print Result
-	var resultMessage ResultMessage
-
-	resultMessage.Status = "ok"
-	resultMessage.Message = "Hello, world!"
-	resultMessage.DesiredCheckCount = len(profileList)
+	resultMessage := newResultMessage(profileList, profileErrors)
 
 Collect:
 
-	for i := 0; i < resultMessage.DesiredCheckCount; i++ {
+	for i := 0; i < len(profileList); i++ {
 		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Waiting i=%d chan", i))
 
 		select {
 		case <-timeoutContext.Done():
-			var resultMessage ResultMessage
 
 			resultMessage.Status = "error"
-			resultMessage.Message = "runtimeout"
+			resultMessage.Message = fmt.Sprintf("run timeout occurred after %dms", AppConfig.RunTimeout.Milliseconds())
+			stopRun(&resultMessage, chJobResult, cancelRun, profileList, ErrorCodeRunTimeout, "run timeout occurred")
 
 			break Collect
 
-		case r := <-chJobResult:
+		case sig := <-chSignal:
 
-			if r.Error == nil {
-				JobResultStatus[r.ProfileID] = ErrorSuccessResult{
-					Success:      "ok",
-					ErrorMessage: r.SuccessMessage,
-				}
-				resultMessage.SucceedCount++
-			} else {
-				JobResultStatus[r.ProfileID] = ErrorSuccessResult{
-					Success:      "error",
-					ErrorMessage: r.Error.Error(),
-				}
-				resultMessage.ErrorCount++
-			}
+			// A second signal kills the process without waiting for the teardown
+			signal.Stop(chSignal)
 
-			resultMessage.ProceedCount++
+			resultMessage.Status = "error"
+			resultMessage.Message = fmt.Sprintf("interrupted by %s", signalName(sig))
+			stopRun(&resultMessage, chJobResult, cancelRun, profileList, ErrorCodeInterrupted, resultMessage.Message)
 
-		}
-	}
+			break Collect
 
-	if resultMessage.ProceedCount != resultMessage.DesiredCheckCount {
-		resultMessage.Status = "error"
+		case r := <-chJobResult:
+			collectJobResult(&resultMessage, r)
+		}
 	}
 
-	if resultMessage.ErrorCount > 0 || resultMessage.ProceedCount == 0 {
-		resultMessage.Status = "error"
-	}
+	resultMessage.setStatus()
 
 	resultMessage.ActiveParallelWorkerCount = AppConfig.ActiveParallelWorkerCount
 
@@ -816,7 +804,149 @@ Collect:
 
 }
 
-func initConfig() {
+// exitWithError prints a result with only the top-level message for an error which stops the run before any profile
+func exitWithError(err error) {
+
+	resultMessage := ResultMessage{
+		Version: ResultSchemaVersion,
+		Status:  "error",
+		Message: err.Error(),
+		Results: json.RawMessage("{}"),
+	}
+
+	r, err := json.Marshal(resultMessage)
+	if err != nil {
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
+	}
+
+	fmt.Println(string(r))
+	os.Exit(1)
+
+}
+
+// stopRun stops the workers, reports the profiles which were not finished with code and waits for their teardown
+func stopRun(resultMessage *ResultMessage, chJobResult chan JobResult, cancelRun context.CancelFunc, profileList WireguardProfileList, code string, reason string) {
+
+	queued, running := JobTracker.stop()
+
+	// Running profiles are reported by the stop, so the workers are aborted only after it
+	cancelRun()
+
+	// Results which arrived while stopping are still reported
+Drain:
+	for {
+		select {
+		case r := <-chJobResult:
+			if _, ok := running[r.ProfileID]; !ok {
+				collectJobResult(resultMessage, r)
+			}
+		default:
+			break Drain
+		}
+	}
+
+	for _, profileId := range queued {
+		JobResultStatus[profileId] = ErrorSuccessResult{
+			Success:      "skipped",
+			ErrorMessage: fmt.Sprintf("%s before the profile was tested", reason),
+			ErrorClass:   errorCodeClass(code),
+			ErrorCode:    code,
+			ProfileID:    profileId,
+			Label:        profileList[profileId].Settings.Label,
+			Tags:         profileList[profileId].Settings.Tags,
+		}
+		resultMessage.SkippedCount++
+	}
+
+	status := "timeout"
+	if code == ErrorCodeInterrupted {
+		status = "interrupted"
+	}
+
+	for profileId, workerNum := range running {
+		if _, ok := JobResultStatus[profileId]; ok {
+			continue
+		}
+		JobResultStatus[profileId] = ErrorSuccessResult{
+			Success:      status,
+			ErrorMessage: fmt.Sprintf("%s while the profile was tested", reason),
+			ErrorClass:   errorCodeClass(code),
+			ErrorCode:    code,
+			ProfileID:    profileId,
+			WorkerID:     workerNum,
+			Label:        profileList[profileId].Settings.Label,
+			Tags:         profileList[profileId].Settings.Tags,
+		}
+		if code == ErrorCodeInterrupted {
+			resultMessage.InterruptedCount++
+		} else {
+			resultMessage.TimeoutCount++
+		}
+	}
+
+	if !JobTracker.waitTeardown(TeardownTimeout) {
+		debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Some tunnels were not torn down after %s", reason))
+	}
+
+}
+
+func signalName(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGINT:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	}
+	return sig.String()
+}
+
+// newResultMessage counts every profile and reports the profiles which failed to load as errors without running
+func newResultMessage(profileList WireguardProfileList, profileErrors map[string]error) ResultMessage {
+
+	var resultMessage ResultMessage
+
+	resultMessage.Version = ResultSchemaVersion
+	resultMessage.Status = "ok"
+	resultMessage.Message = "Hello, world!"
+	resultMessage.DesiredCheckCount = len(profileList) + len(profileErrors)
+
+	for profileId, err := range profileErrors {
+		JobResultStatus[profileId] = newProfileErrorResult(profileId, err)
+		resultMessage.ErrorCount++
+		resultMessage.ProceedCount++
+	}
+
+	return resultMessage
+
+}
+
+// setStatus fails the run if a profile failed, was not proceeded or no profile was proceeded at all
+func (resultMessage *ResultMessage) setStatus() {
+
+	if resultMessage.ProceedCount != resultMessage.DesiredCheckCount {
+		resultMessage.Status = "error"
+	}
+
+	if resultMessage.ErrorCount > 0 || resultMessage.ProceedCount == 0 {
+		resultMessage.Status = "error"
+	}
+
+}
+
+func collectJobResult(resultMessage *ResultMessage, r JobResult) {
+
+	JobResultStatus[r.ProfileID] = newErrorSuccessResult(r)
+	if r.Error == nil {
+		resultMessage.SucceedCount++
+	} else {
+		resultMessage.ErrorCount++
+	}
+
+	resultMessage.ProceedCount++
+
+}
+
+func initConfig() error {
 
 	DebugLevel = DEBUG_SHOW_ERROR_MESSAGE
 	DebugLevel += DEBUG_SHOW_CRITICAL_MESSAGE
@@ -824,22 +954,77 @@ func initConfig() {
 	DebugLevel += DEBUG_SHOW_DEBUG_MESSAGE
 
 	AppConfig.HealthCheckMethod = HCMethodICMP
+	AppConfig.HealthCheckPolicy = HealthCheckPolicyAll
 	AppConfig.HealthCheckEndpoint = "1.0.0.1"
+	AppConfig.HealthCheckIPFamilies = []int{4}
 	AppConfig.HealthCheckTimeout = 3 * time.Second
 	AppConfig.HealthCheckInterval = 1 * time.Second
 	AppConfig.HealthCheckRunTimeout = 10 * time.Second
 	AppConfig.HealthCheckRetries = 3
 	AppConfig.RunTimeout = 30 * time.Second
 	AppConfig.WorkerCount = 8
+	AppConfig.EndpointResolvePrefer = "ipv4"
+	AppConfig.HandshakeTimeout = 5 * time.Second
+	AppConfig.WireguardBackend = WireguardBackendUserspace
 
 	if val := os.Getenv("HEALTHCHECK_METHOD"); val != "" {
 		AppConfig.HealthCheckMethod = val
 	}
 
+	// Falling back to HEALTHCHECK_METHOD would report a different test as the result of HEALTHCHECKS
+	if val := os.Getenv("HEALTHCHECKS"); val != "" {
+		var healthChecks []HealthCheck
+		err := json.Unmarshal([]byte(val), &healthChecks)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("HEALTHCHECKS value error %s // %s", val, err.Error()))
+			return fmt.Errorf("HEALTHCHECKS value error: %w", err)
+		}
+		AppConfig.HealthChecks = healthChecks
+	}
+
+	// A typo in a check would otherwise be reported as a failure of every profile
+	if err := checkHealthChecks(configuredHealthChecks()); err != nil {
+		debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("HEALTHCHECKS value error // %s", err.Error()))
+		return fmt.Errorf("HEALTHCHECKS value error: %w", err)
+	}
+
+	if val := os.Getenv("HEALTHCHECK_POLICY"); val != "" {
+		// Falling back to all would decide the results by a different policy than the one asked for
+		err := parseHealthCheckPolicy(val)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("HEALTHCHECK_POLICY value error %s // %s", val, err.Error()))
+			return fmt.Errorf("HEALTHCHECK_POLICY value error: %w", err)
+		}
+		AppConfig.HealthCheckPolicy = val
+	}
+
+	// Every profile without checks of its own would be reported as PROFILE_PARSE for a wrong setting of the run
+	if err := checkHealthCheckQuorum(AppConfig.HealthCheckPolicy, len(configuredHealthChecks())); err != nil {
+		debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("HEALTHCHECK_POLICY value error // %s", err.Error()))
+		return fmt.Errorf("HEALTHCHECK_POLICY value error: %w", err)
+	}
+
 	if val := os.Getenv("HEALTHCHECK_ENDPOINT"); val != "" {
 		AppConfig.HealthCheckEndpoint = val
 	}
 
+	if val := os.Getenv("HEALTHCHECK_ENDPOINT6"); val != "" {
+		AppConfig.HealthCheckEndpoint6 = val
+	}
+
+	if val := os.Getenv("HEALTHCHECK_IP_FAMILY"); val != "" {
+		switch val {
+		case "4", "ipv4":
+			AppConfig.HealthCheckIPFamilies = []int{4}
+		case "6", "ipv6":
+			AppConfig.HealthCheckIPFamilies = []int{6}
+		case "both", "dual":
+			AppConfig.HealthCheckIPFamilies = []int{4, 6}
+		default:
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("HEALTHCHECK_IP_FAMILY value error %s", val))
+		}
+	}
+
 	if val := os.Getenv("HEALTHCHECK_TIMEOUT"); val != "" {
 		i, err := strconv.Atoi(val)
 		if err != nil {
@@ -876,6 +1061,15 @@ func initConfig() {
 		}
 	}
 
+	if val := os.Getenv("HANDSHAKE_TIMEOUT"); val != "" {
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("HANDSHAKE_TIMEOUT value error %s", val))
+		} else {
+			AppConfig.HandshakeTimeout = time.Duration(i * int(time.Millisecond))
+		}
+	}
+
 	if val := os.Getenv("RUNTIMEOUT"); val != "" {
 		i, err := strconv.Atoi(val)
 		if err != nil {
@@ -898,6 +1092,71 @@ func initConfig() {
 		AppConfig.RemoteProfilePath = val
 	}
 
+	if val := os.Getenv("PROFILE_DATA_SINGLE"); val != "" {
+		AppConfig.ProfileDataSingle = val
+	}
+
+	if val := os.Getenv("PROFILE_ID_SINGLE"); val != "" {
+		AppConfig.ProfileIDSingle = val
+	}
+
+	if val := os.Getenv("PROFILE_DIRECTORY_RECURSIVE"); val != "" {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("PROFILE_DIRECTORY_RECURSIVE value error %s", val))
+		} else {
+			AppConfig.ProfileDirectoryRecursive = b
+		}
+	}
+
+	if val := os.Getenv("PROFILE_INCLUDE"); val != "" {
+		AppConfig.ProfileInclude = splitList(val)
+	}
+
+	if val := os.Getenv("PROFILE_EXCLUDE"); val != "" {
+		AppConfig.ProfileExclude = splitList(val)
+	}
+
+	if val := os.Getenv("ENDPOINT_RESOLVER"); val != "" {
+		AppConfig.EndpointResolver = val
+	}
+
+	if val := os.Getenv("ENDPOINT_RESOLVE_PREFER"); val != "" {
+		switch val {
+		case "ipv4", "ipv6", "ipv4only", "ipv6only":
+			AppConfig.EndpointResolvePrefer = val
+		default:
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("ENDPOINT_RESOLVE_PREFER value error %s", val))
+		}
+	}
+
+	if val := os.Getenv("WG_BACKEND"); val != "" {
+		switch val {
+		case WireguardBackendKernel, WireguardBackendUserspace, WireguardBackendProcess, WireguardBackendNetstack:
+			AppConfig.WireguardBackend = val
+		default:
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("WG_BACKEND value error %s", val))
+		}
+	}
+
+	if val := os.Getenv("WG_NETNS"); val != "" {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("WG_NETNS value error %s", val))
+		} else {
+			AppConfig.NetworkNamespace = b
+		}
+	}
+
+	if val := os.Getenv("WG_CLEANUP"); val != "" {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("WG_CLEANUP value error %s", val))
+		} else {
+			AppConfig.CleanupStale = b
+		}
+	}
+
 	if val := os.Getenv("DEBUG_LEVEL"); val != "" {
 		i, err := strconv.Atoi(val)
 		if err == nil && i > 0 {
@@ -905,11 +1164,27 @@ func initConfig() {
 		}
 	}
 
+	return nil
+
+}
+
+// splitList splits a comma separated environment value and drops empty items
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
 }
 
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	WireguardWorkersJob = make(map[int]WireguardJobList)
 	JobResultStatus = make(map[string]ErrorSuccessResult)
+	JobTracker = newJobTracker()
 	defaultGatewayAddress = GetDefaultGateway()
+	defaultGateway6Address, defaultGateway6Device = GetDefaultGateway6()
 }
@@ -2,14 +2,21 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+const EndpointResolveTimeout = 5 * time.Second
+
 func GetOutboundIP() net.IP {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
@@ -67,6 +74,193 @@ func GetDefaultGateway() string {
 	return ip
 }
 
+// GetDefaultGateway6 returns the next hop and the device of the IPv6 default route.
+// IPv6 gateways are usually link-local addresses, so the device is required to use it.
+func GetDefaultGateway6() (string, string) {
+
+	file, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, err.Error())
+		return "", ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+
+		// dest dest_prefix src src_prefix nexthop metric refcnt use flags devname
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) < 10 {
+			continue
+		}
+
+		if tokens[0] != strings.Repeat("0", 32) || tokens[1] != "00" {
+			continue
+		}
+
+		nextHop, err := hex.DecodeString(tokens[4])
+		if err != nil || len(nextHop) != net.IPv6len {
+			continue
+		}
+
+		ip := net.IP(nextHop)
+		if ip.IsUnspecified() {
+			continue
+		}
+
+		return ip.String(), tokens[9]
+	}
+
+	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, "Couldn't get IPv6 default gateway")
+
+	return "", ""
+}
+
+// EndpointResolveError is returned when a peer endpoint hostname cannot be resolved with the underlay resolver.
+// It is reported separately so that DNS problems can be told apart from tunnel problems.
+type EndpointResolveError struct {
+	Host string
+	Err  error
+}
+
+func (e *EndpointResolveError) Error() string {
+	return fmt.Sprintf("cannot resolve endpoint %s: %s", e.Host, e.Err.Error())
+}
+
+func (e *EndpointResolveError) Unwrap() error {
+	return e.Err
+}
+
+// endpointResolver returns the underlay resolver. ENDPOINT_RESOLVER replaces the system resolver.
+func endpointResolver() *net.Resolver {
+
+	if AppConfig.EndpointResolver == "" {
+		return net.DefaultResolver
+	}
+
+	server := AppConfig.EndpointResolver
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// resolveEndpoint resolves a peer endpoint hostname by ENDPOINT_RESOLVE_PREFER
+func resolveEndpoint(ctx context.Context, host string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, EndpointResolveTimeout)
+	defer cancel()
+
+	network := "ip"
+	switch AppConfig.EndpointResolvePrefer {
+	case "ipv4only":
+		network = "ip4"
+	case "ipv6only":
+		network = "ip6"
+	}
+
+	ips, err := endpointResolver().LookupIP(ctx, network, host)
+	if err != nil {
+		return "", &EndpointResolveError{Host: host, Err: err}
+	}
+
+	preferFamily := 4
+	if AppConfig.EndpointResolvePrefer == "ipv6" {
+		preferFamily = 6
+	}
+
+	for _, ip := range ips {
+		if ipFamily(ip) == preferFamily {
+			return ip.String(), nil
+		}
+	}
+
+	if len(ips) == 0 {
+		return "", &EndpointResolveError{Host: host, Err: errors.New("no address")}
+	}
+
+	return ips[0].String(), nil
+}
+
+// endpointResolution is the address of an endpoint hostname, or why it could not be resolved
+type endpointResolution struct {
+	ip  string
+	err error
+}
+
+// resolveProfileEndpoints replaces endpoint hostnames of every peer with their address before routes are set up.
+// Profiles whose endpoint cannot be resolved are moved to profileErrors. If ctx is done first, no profile is changed,
+// because the stopped run reports every profile itself.
+func resolveProfileEndpoints(ctx context.Context, profileList WireguardProfileList, profileErrors map[string]error) {
+
+	// Each hostname is resolved once, all of them at the same time, so that dead names do not add up
+	resolved := make(map[string]*endpointResolution)
+	for _, profile := range profileList {
+		for _, peer := range profile.Peers {
+			if peer.EndpointIP != "" && net.ParseIP(peer.EndpointIP) == nil {
+				resolved[peer.EndpointIP] = &endpointResolution{}
+			}
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	for host, resolution := range resolved {
+		wg.Add(1)
+		go func(host string, resolution *endpointResolution) {
+			defer wg.Done()
+			resolution.ip, resolution.err = resolveEndpoint(ctx, host)
+			if resolution.err == nil {
+				debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("Resolved endpoint %s = %s", host, resolution.ip))
+			}
+		}(host, resolution)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	for profileId, profile := range profileList {
+
+		var err error
+
+		for i := range profile.Peers {
+
+			peer := &profile.Peers[i]
+			resolution, ok := resolved[peer.EndpointIP]
+			if !ok {
+				continue
+			}
+
+			err = resolution.err
+			if err != nil {
+				break
+			}
+			peer.EndpointHost = peer.EndpointIP
+			peer.EndpointIP = resolution.ip
+
+		}
+
+		if err != nil {
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Profile [%s] %s", profileId, err.Error()))
+			profileErrors[profileId] = profile.Settings.entryError(err)
+			delete(profileList, profileId)
+			continue
+		}
+
+		profileList[profileId] = profile
+
+	}
+
+}
+
 // func UpdateResolver() {
 
 // 	debugMessage("Update /etc/resolv.conf")
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// RouterTableBase is added to the profile sequence to get the routing table of a profile
+const RouterTableBase = 1000
+
+// RouterProtocol is the protocol (rtm_protocol) of the rules and the endpoint routes of this tool,
+// so that a later run can tell them apart from the ones of somebody else
+const RouterProtocol = 0x57
+
+// NetlinkError is a failed netlink operation on one network object
+type NetlinkError struct {
+	Op     string // add, delete, get, set
+	Object string // e.g. "route 0.0.0.0/0 table 1001"
+	Err    error
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("netlink %s %s: %s", e.Op, e.Object, e.Err.Error())
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Err
+}
+
+// networkObject is an address, route or rule which was created by a NetworkSetup
+type networkObject struct {
+	description string
+	remove      func() error
+}
+
+// NetworkSetup adds the addresses, routes and rules of a wireguard interface and records the ones it created.
+// Objects which already existed are left alone, so running a step twice is harmless and
+// Rollback removes exactly what this setup added.
+// With WG_NETNS the interface is moved into its own namespace first and routed by the main table of it.
+type NetworkSetup struct {
+	InterfaceName string
+	RouterTableID int
+	Namespace     *networkNamespace
+	handle        *netlink.Handle
+	created       []networkObject
+}
+
+func newNetworkSetup(wireguardInterfaceName string) *NetworkSetup {
+	return &NetworkSetup{InterfaceName: wireguardInterfaceName}
+}
+
+// add runs an add operation and records the object. EEXIST means somebody else owns the object.
+func (n *NetworkSetup) add(description string, add func() error, remove func() error) error {
+
+	debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("[%s] add %s", n.InterfaceName, description))
+
+	err := add()
+	if errors.Is(err, syscall.EEXIST) {
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("[%s] %s already exists", n.InterfaceName, description))
+		return nil
+	}
+	if err != nil {
+		return &NetlinkError{Op: "add", Object: description, Err: err}
+	}
+
+	n.created = append(n.created, networkObject{description: description, remove: remove})
+
+	return nil
+
+}
+
+// Setup configures the interface of the profile. On error the objects which were added stay recorded for Rollback.
+func (n *NetworkSetup) Setup(profile WireguardQuickConf) error {
+
+	n.handle = &netlink.Handle{}
+
+	if AppConfig.NetworkNamespace {
+		err := n.setupNamespace()
+		if err != nil {
+			return err
+		}
+	}
+
+	link, err := n.handle.LinkByName(n.InterfaceName)
+	if err != nil {
+		return &NetlinkError{Op: "get", Object: "link " + n.InterfaceName, Err: err}
+	}
+
+	for _, address := range profile.Interface.Addresses {
+		addr, err := netlink.ParseAddr(hostPrefixString(address))
+		if err != nil {
+			return err
+		}
+		err = n.add(fmt.Sprintf("address %s dev %s", addr.IPNet, n.InterfaceName),
+			func() error { return n.handle.AddrAdd(link, addr) },
+			func() error { return n.handle.AddrDel(link, addr) })
+		if err != nil {
+			return err
+		}
+	}
+
+	if profile.Interface.MTU != 0 {
+		err = n.handle.LinkSetMTU(link, profile.Interface.MTU)
+		if err != nil {
+			return &NetlinkError{Op: "set", Object: fmt.Sprintf("mtu %d dev %s", profile.Interface.MTU, n.InterfaceName), Err: err}
+		}
+	}
+
+	err = n.handle.LinkSetUp(link)
+	if err != nil {
+		return &NetlinkError{Op: "set", Object: "up dev " + n.InterfaceName, Err: err}
+	}
+
+	if n.Namespace != nil {
+		// The namespace has nothing else to route, so the main table is used and no rule is needed
+		return n.addDefaultRoutes(profile, link)
+	}
+
+	// Pin the peer endpoints to the underlay default gateway. Profiles which share any endpoint run on
+	// one worker one after another, so the route is added by the first and found by the next ones.
+	for _, endpointIP := range profile.EndpointIPs() {
+		route, err := endpointRoute(endpointIP)
+		if err != nil {
+			return err
+		}
+		err = n.addRoute(route)
+		if err != nil {
+			return err
+		}
+	}
+
+	n.RouterTableID = profile.ProfileSequence + RouterTableBase
+
+	err = n.addDefaultRoutes(profile, link)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range profile.Interface.Addresses {
+		addr, err := netlink.ParseAddr(hostPrefixString(address))
+		if err != nil {
+			return err
+		}
+		rule := netlink.NewRule()
+		rule.Src = addr.IPNet
+		rule.Table = n.RouterTableID
+		rule.Family = netlinkFamily(addr.IP)
+		rule.Protocol = RouterProtocol
+		err = n.add(fmt.Sprintf("rule from %s table %d", addr.IPNet, n.RouterTableID),
+			func() error { return addRule(rule) },
+			func() error { return netlink.RuleDel(rule) })
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// addDefaultRoutes routes every destination of the families of the interface addresses into the interface
+func (n *NetworkSetup) addDefaultRoutes(profile WireguardQuickConf, link netlink.Link) error {
+
+	var err error
+
+	if address := profile.InterfaceAddress(4); address != "" {
+		err = n.addRoute(&netlink.Route{
+			Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Gw:        net.ParseIP(address),
+			LinkIndex: link.Attrs().Index,
+			Table:     n.RouterTableID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if address := profile.InterfaceAddress(6); address != "" {
+		err = n.addRoute(&netlink.Route{
+			Dst:       &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+			LinkIndex: link.Attrs().Index,
+			Table:     n.RouterTableID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// setupNamespace creates the namespace of the interface, moves the interface into it and continues the setup there
+func (n *NetworkSetup) setupNamespace() error {
+
+	link, err := netlink.LinkByName(n.InterfaceName)
+	if err != nil {
+		return &NetlinkError{Op: "get", Object: "link " + n.InterfaceName, Err: err}
+	}
+
+	ns, err := createNetworkNamespace(n.InterfaceName)
+	if err != nil {
+		return &NetlinkError{Op: "add", Object: "netns " + n.InterfaceName, Err: err}
+	}
+
+	handle, err := netlink.NewHandleAt(ns.handle)
+	if err != nil {
+		if deleteErr := ns.Delete(); deleteErr != nil {
+			debugMessage(DEBUG_SHOW_CHAOS_MESSAGE, fmt.Sprintf("cannot delete netns %s // %s", ns.name, deleteErr.Error()))
+		}
+		return &NetlinkError{Op: "get", Object: "netns " + ns.name, Err: err}
+	}
+
+	// Deleting the namespace removes everything inside, so nothing else is recorded
+	n.Namespace = ns
+	n.handle = handle
+	n.created = append(n.created, networkObject{description: "netns " + ns.name, remove: func() error {
+		handle.Close()
+		return ns.Delete()
+	}})
+
+	err = netlink.LinkSetNsFd(link, int(ns.handle))
+	if err != nil {
+		return &NetlinkError{Op: "set", Object: fmt.Sprintf("netns %s dev %s", ns.name, n.InterfaceName), Err: err}
+	}
+
+	loopback, err := n.handle.LinkByName("lo")
+	if err == nil {
+		err = n.handle.LinkSetUp(loopback)
+	}
+	if err != nil {
+		return &NetlinkError{Op: "set", Object: "up dev lo", Err: err}
+	}
+
+	return nil
+
+}
+
+func (n *NetworkSetup) addRoute(route *netlink.Route) error {
+	description := fmt.Sprintf("route %s", route.Dst)
+	if route.Gw != nil {
+		description += fmt.Sprintf(" via %s", route.Gw)
+	}
+	if route.Table != 0 {
+		description += fmt.Sprintf(" table %d", route.Table)
+	}
+	return n.add(description,
+		func() error { return n.handle.RouteAdd(route) },
+		func() error { return n.handle.RouteDel(route) })
+}
+
+// addRule adds a rule without priority and stores the priority which the kernel picked,
+// so that deleting it never removes an identical rule of somebody else
+func addRule(rule *netlink.Rule) error {
+
+	err := netlink.RuleAdd(rule)
+	if err != nil {
+		return err
+	}
+
+	// The kernel puts a rule without priority right above the first one after the local rule
+	rules, err := netlink.RuleListFiltered(rule.Family, &netlink.Rule{Src: rule.Src, Table: rule.Table}, netlink.RT_FILTER_SRC|netlink.RT_FILTER_TABLE)
+	if err != nil || len(rules) == 0 {
+		return nil
+	}
+
+	rule.Priority = rules[0].Priority
+	for _, r := range rules[1:] {
+		if r.Priority < rule.Priority {
+			rule.Priority = r.Priority
+		}
+	}
+
+	return nil
+
+}
+
+// Rollback removes the recorded objects in reverse order. Objects which are already gone,
+// for example routes of a deleted link, are not an error.
+func (n *NetworkSetup) Rollback() error {
+
+	var errs []error
+
+	for i := len(n.created) - 1; i >= 0; i-- {
+
+		object := n.created[i]
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("[%s] delete %s", n.InterfaceName, object.description))
+
+		err := object.remove()
+		if err != nil && !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ESRCH) && !errors.Is(err, syscall.EADDRNOTAVAIL) && !errors.Is(err, syscall.ENODEV) {
+			errs = append(errs, &NetlinkError{Op: "delete", Object: object.description, Err: err})
+		}
+
+	}
+
+	n.created = nil
+
+	return errors.Join(errs...)
+
+}
+
+// endpointRoute routes a peer endpoint through the underlay default gateway with metric 1
+func endpointRoute(endpointIP string) (*netlink.Route, error) {
+
+	ip := net.ParseIP(endpointIP)
+	if ip == nil {
+		return nil, fmt.Errorf("endpoint %s is not an IP address", endpointIP)
+	}
+
+	if ip.To4() != nil {
+		return &netlink.Route{
+			Dst:      &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)},
+			Gw:       net.ParseIP(defaultGatewayAddress),
+			Priority: 1,
+			Protocol: RouterProtocol,
+		}, nil
+	}
+
+	route := &netlink.Route{
+		Dst:      &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)},
+		Gw:       net.ParseIP(defaultGateway6Address),
+		Priority: 1,
+		Protocol: RouterProtocol,
+	}
+
+	gatewayLink, err := netlink.LinkByName(defaultGateway6Device)
+	if err != nil {
+		return nil, &NetlinkError{Op: "get", Object: "link " + defaultGateway6Device, Err: err}
+	}
+	route.LinkIndex = gatewayLink.Attrs().Index
+
+	return route, nil
+
+}
+
+func netlinkFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
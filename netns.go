@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/icmp"
+)
+
+// networkNamespace is the named network namespace (/var/run/netns/<ifname>) of a profile.
+// The wireguard socket stays in the namespace of this process, so only the interface is moved.
+type networkNamespace struct {
+	name   string
+	handle netns.NsHandle
+}
+
+// createNetworkNamespace creates a named network namespace without leaving the current one
+func createNetworkNamespace(name string) (*networkNamespace, error) {
+
+	ns := &networkNamespace{name: name}
+
+	// NewNamed switches the thread into the new namespace
+	err := inNetworkNamespace(func() (err error) {
+		ns.handle, err = netns.NewNamed(name)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ns, nil
+
+}
+
+// Delete removes the name of the namespace. The kernel frees it with its interfaces when the last socket is closed.
+func (ns *networkNamespace) Delete() error {
+	ns.handle.Close()
+	return netns.DeleteNamed(ns.name)
+}
+
+// run calls fn on a thread which is in the namespace
+func (ns *networkNamespace) run(fn func() error) error {
+	return inNetworkNamespace(func() error {
+		err := netns.Set(ns.handle)
+		if err != nil {
+			return fmt.Errorf("cannot enter network namespace %s: %w", ns.name, err)
+		}
+		return fn()
+	})
+}
+
+// inNetworkNamespace locks the thread for fn, which may switch its namespace, and switches it back afterwards.
+// A thread which cannot be switched back stays locked, so that the runtime throws it away with the goroutine.
+func inNetworkNamespace(fn func() error) error {
+
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+
+	fnErr := fn()
+
+	err = netns.Set(origin)
+	if err != nil {
+		debugMessage(DEBUG_SHOW_CRITICAL_MESSAGE, fmt.Sprintf("cannot return to the network namespace of this process // %s", err.Error()))
+		return err
+	}
+
+	runtime.UnlockOSThread()
+
+	return fnErr
+
+}
+
+// DialContext opens the socket in the namespace. Once opened a socket stays there, so it can be used from any thread.
+// ping4 and ping6 open a raw icmp socket which needs CAP_NET_RAW.
+func (ns *networkNamespace) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+
+	// The resolver and the fallback of a dual stack dial run on other goroutines, which are not in the namespace.
+	// A hostname is resolved first like the checks of the other backends do, so that only the literal address is dialed.
+	if network != "ping4" && network != "ping6" {
+		address, err = resolveDialAddress(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = ns.run(func() (err error) {
+		switch network {
+		case "ping4", "ping6":
+			conn, err = dialPing(network, address)
+		default:
+			conn, err = (&net.Dialer{FallbackDelay: -1}).DialContext(ctx, network, address)
+		}
+		return
+	})
+
+	return
+
+}
+
+// pingConn is a raw icmp socket which reads and writes one peer like a connected socket
+type pingConn struct {
+	*icmp.PacketConn
+	remote net.Addr
+}
+
+func dialPing(network, address string) (net.Conn, error) {
+
+	listenNetwork, listenAddress := "ip4:icmp", "0.0.0.0"
+	if network == "ping6" {
+		listenNetwork, listenAddress = "ip6:ipv6-icmp", "::"
+	}
+
+	remote, err := net.ResolveIPAddr(listenNetwork[:3], address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := icmp.ListenPacket(listenNetwork, listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pingConn{PacketConn: conn, remote: remote}, nil
+
+}
+
+func (c *pingConn) Read(b []byte) (int, error) {
+	for {
+		n, peer, err := c.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		// the raw socket receives the icmp packets of every peer
+		if peer.String() == c.remote.String() {
+			return n, nil
+		}
+	}
+}
+
+func (c *pingConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.remote)
+}
+
+func (c *pingConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// WireguardProfileEntry is a profile of profile.json. It is either the base64 encoded wg-quick profile
+// itself or an object of it and the settings of the profile.
+//
+//	{"site-a": "W0ludGVyZmFjZV0K...", "site-b": {"config": "W0ludGVyZmFjZV0K...", "label": "Site B", "checks": [...]}}
+type WireguardProfileEntry struct {
+	Config string `json:"config"` // base64 encoded wg-quick profile
+	ProfileSettings
+}
+
+// ProfileSettings override the environment for one profile. Timeouts are in milliseconds like their environment variables.
+type ProfileSettings struct {
+	Label                 string        `json:"label,omitempty"`
+	Tags                  []string      `json:"tags,omitempty"`
+	HealthChecks          []HealthCheck `json:"checks,omitempty"`                // HEALTHCHECKS
+	HealthCheckPolicy     string        `json:"policy,omitempty"`                // HEALTHCHECK_POLICY
+	HandshakeTimeout      *int          `json:"handshaketimeout,omitempty"`      // HANDSHAKE_TIMEOUT, 0 disables the handshake check
+	HealthCheckTimeout    int           `json:"healthchecktimeout,omitempty"`    // HEALTHCHECK_TIMEOUT
+	HealthCheckRunTimeout int           `json:"healthcheckruntimeout,omitempty"` // HEALTHCHECK_RUNTIMEOUT
+}
+
+// ProfileEntryError is the error of a profile which keeps the label and tags of its entry for the result
+type ProfileEntryError struct {
+	Label string
+	Tags  []string
+	Err   error
+}
+
+func (e *ProfileEntryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProfileEntryError) Unwrap() error {
+	return e.Err
+}
+
+// entryError attaches the label and tags of the settings to err
+func (s ProfileSettings) entryError(err error) error {
+	if s.Label == "" && len(s.Tags) == 0 {
+		return err
+	}
+	return &ProfileEntryError{Label: s.Label, Tags: s.Tags, Err: err}
+}
+
+func (e *WireguardProfileEntry) UnmarshalJSON(data []byte) error {
+
+	// The string form of the first profile.json
+	if err := json.Unmarshal(data, &e.Config); err == nil {
+		return nil
+	}
+
+	// The label and tags are read first, so that an entry which is not valid is still reported with them
+	var labels struct {
+		Label string   `json:"label"`
+		Tags  []string `json:"tags"`
+	}
+	if json.Unmarshal(data, &labels) == nil {
+		e.Label, e.Tags = labels.Label, labels.Tags
+	}
+
+	type entry WireguardProfileEntry
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode((*entry)(e))
+	if err != nil {
+		return err
+	}
+
+	if e.Config == "" {
+		return fmt.Errorf("config is empty")
+	}
+
+	if e.HealthCheckPolicy != "" {
+		err = parseHealthCheckPolicy(e.HealthCheckPolicy)
+		if err != nil {
+			return fmt.Errorf("policy error: %w", err)
+		}
+	}
+
+	return nil
+
+}
+
+// decodeProfileList decodes profile.json. Entries which are not valid are reported in profileErrors.
+func decodeProfileList(data []byte) (rawList WireguardProfileListRaw, profileErrors map[string]error, err error) {
+
+	var rawEntries map[string]json.RawMessage
+	err = json.Unmarshal(data, &rawEntries)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawList = make(WireguardProfileListRaw)
+	profileErrors = make(map[string]error)
+
+	for profileId, rawEntry := range rawEntries {
+		var entry WireguardProfileEntry
+		err = json.Unmarshal(rawEntry, &entry)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Profile [%s] entry error // %s", profileId, err.Error()))
+			profileErrors[profileId] = entry.entryError(fmt.Errorf("profile.json entry error: %w", err))
+			continue
+		}
+		rawList[profileId] = entry
+	}
+
+	return rawList, profileErrors, nil
+
+}
+
+// healthChecks returns the checks of the profile, or HEALTHCHECKS
+func (s ProfileSettings) healthChecks() []HealthCheck {
+	if len(s.HealthChecks) > 0 {
+		return s.HealthChecks
+	}
+	return configuredHealthChecks()
+}
+
+func (s ProfileSettings) healthCheckPolicy() string {
+	if s.HealthCheckPolicy != "" {
+		return s.HealthCheckPolicy
+	}
+	return AppConfig.HealthCheckPolicy
+}
+
+func (s ProfileSettings) handshakeTimeout() time.Duration {
+	if s.HandshakeTimeout != nil {
+		return time.Duration(*s.HandshakeTimeout) * time.Millisecond
+	}
+	return AppConfig.HandshakeTimeout
+}
+
+func (s ProfileSettings) healthCheckTimeout() time.Duration {
+	if s.HealthCheckTimeout > 0 {
+		return time.Duration(s.HealthCheckTimeout) * time.Millisecond
+	}
+	return AppConfig.HealthCheckTimeout
+}
+
+func (s ProfileSettings) healthCheckRunTimeout() time.Duration {
+	if s.HealthCheckRunTimeout > 0 {
+		return time.Duration(s.HealthCheckRunTimeout) * time.Millisecond
+	}
+	return AppConfig.HealthCheckRunTimeout
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeProfileList(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		data    string
+		entries map[string]WireguardProfileEntry
+		errors  map[string]string // profile id = part of the error
+		labels  map[string]string // label of a failed entry
+		err     bool
+	}{
+		{
+			name: "string form",
+			data: `{"a": "W0ludGVyZmFjZV0K", "b": "W1BlZXJdCg=="}`,
+			entries: map[string]WireguardProfileEntry{
+				"a": {Config: "W0ludGVyZmFjZV0K"},
+				"b": {Config: "W1BlZXJdCg=="},
+			},
+		},
+		{
+			name: "object form",
+			data: `{"a": {"config": "W0ludGVyZmFjZV0K", "label": "Site A", "tags": ["prod"], "policy": "quorum:1",
+				"checks": [{"method": "tcp"}, {"method": "icmp"}], "handshaketimeout": 0, "healthchecktimeout": 500}}`,
+			entries: map[string]WireguardProfileEntry{
+				"a": {Config: "W0ludGVyZmFjZV0K", ProfileSettings: ProfileSettings{
+					Label:              "Site A",
+					Tags:               []string{"prod"},
+					HealthChecks:       []HealthCheck{{Method: "tcp"}, {Method: "icmp"}},
+					HealthCheckPolicy:  "quorum:1",
+					HandshakeTimeout:   new(int),
+					HealthCheckTimeout: 500,
+				}},
+			},
+		},
+		{
+			name: "invalid entries",
+			data: `{"ok": "W0ludGVyZmFjZV0K", "unknown": {"config": "W0ludGVyZmFjZV0K", "label": "U", "retries": 3},
+				"policy": {"config": "W0ludGVyZmFjZV0K", "label": "P", "policy": "most"}, "empty": {"tags": ["t"]}, "number": 1}`,
+			entries: map[string]WireguardProfileEntry{
+				"ok": {Config: "W0ludGVyZmFjZV0K"},
+			},
+			errors: map[string]string{
+				"unknown": `unknown field "retries"`,
+				"policy":  "unknown policy most",
+				"empty":   "config is empty",
+				"number":  "cannot unmarshal number",
+			},
+			labels: map[string]string{"unknown": "U", "policy": "P"},
+		},
+		{
+			name: "not an object",
+			data: `["W0ludGVyZmFjZV0K"]`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			rawList, profileErrors, err := decodeProfileList([]byte(test.data))
+			if test.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(map[string]WireguardProfileEntry(rawList), test.entries) {
+				t.Errorf("entries = %+v, want %+v", rawList, test.entries)
+			}
+
+			if len(profileErrors) != len(test.errors) {
+				t.Errorf("errors = %v, want %v", profileErrors, test.errors)
+			}
+			for profileId, want := range test.errors {
+				err := profileErrors[profileId]
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("error of %s = %v, want %q", profileId, err, want)
+					continue
+				}
+				var entryError *ProfileEntryError
+				errors.As(err, &entryError)
+				label := ""
+				if entryError != nil {
+					label = entryError.Label
+				}
+				if label != test.labels[profileId] {
+					t.Errorf("label of %s = %q, want %q", profileId, label, test.labels[profileId])
+				}
+			}
+
+		})
+	}
+
+}
+
+func TestMatchProfileFile(t *testing.T) {
+
+	defer func(include, exclude []string) {
+		AppConfig.ProfileInclude, AppConfig.ProfileExclude = include, exclude
+	}(AppConfig.ProfileInclude, AppConfig.ProfileExclude)
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		path    string
+		match   bool
+	}{
+		{name: "no filter", path: "site/a.conf", match: true},
+		{name: "include filename", include: []string{"a*.conf"}, path: "site/a1.conf", match: true},
+		{name: "include other filename", include: []string{"a*.conf"}, path: "site/b1.conf"},
+		{name: "include path", include: []string{"site/*.conf"}, path: "site/b1.conf", match: true},
+		{name: "include other path", include: []string{"site/*.conf"}, path: "b1.conf"},
+		{name: "one of includes", include: []string{"a*.conf", "b*.conf"}, path: "b1.conf", match: true},
+		{name: "exclude filename", exclude: []string{"*-old.conf"}, path: "site/a-old.conf"},
+		{name: "exclude wins", include: []string{"a*.conf"}, exclude: []string{"a2.conf"}, path: "a2.conf"},
+		{name: "not excluded", include: []string{"a*.conf"}, exclude: []string{"a2.conf"}, path: "a1.conf", match: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			AppConfig.ProfileInclude, AppConfig.ProfileExclude = test.include, test.exclude
+			if match := matchProfileFile(test.path); match != test.match {
+				t.Errorf("matchProfileFile(%s) = %t, want %t", test.path, match, test.match)
+			}
+		})
+	}
+
+}
+
+func TestLoadProfileDirectory(t *testing.T) {
+
+	defer func(recursive bool, include, exclude []string) {
+		AppConfig.ProfileDirectoryRecursive, AppConfig.ProfileInclude, AppConfig.ProfileExclude = recursive, include, exclude
+	}(AppConfig.ProfileDirectoryRecursive, AppConfig.ProfileInclude, AppConfig.ProfileExclude)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.conf":          "A",
+		"b.conf":          "B",
+		"notes.txt":       "N",
+		".conf":           "E",
+		"site/c.conf":     "C",
+		"site/a.conf":     "A2",
+		"site/old/d.conf": "D",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	encode := func(data string) WireguardProfileEntry {
+		return WireguardProfileEntry{Config: base64.StdEncoding.EncodeToString([]byte(data))}
+	}
+
+	tests := []struct {
+		name      string
+		recursive bool
+		exclude   []string
+		entries   map[string]WireguardProfileEntry
+		errors    map[string]string // key = part of the error
+	}{
+		{
+			name:    "top level only",
+			entries: map[string]WireguardProfileEntry{"a": encode("A"), "b": encode("B")},
+			errors:  map[string]string{"file:.conf": "profile id is empty"},
+		},
+		{
+			name:      "recursive",
+			recursive: true,
+			entries:   map[string]WireguardProfileEntry{"a": encode("A"), "b": encode("B"), "c": encode("C"), "d": encode("D")},
+			errors: map[string]string{
+				"file:.conf":       "profile id is empty",
+				"file:site/a.conf": "duplicated profile id [a] with a.conf",
+			},
+		},
+		{
+			name:      "recursive with exclude",
+			recursive: true,
+			exclude:   []string{"site/old/*", ".conf", "a.conf"},
+			entries:   map[string]WireguardProfileEntry{"b": encode("B"), "c": encode("C")},
+			errors:    map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			AppConfig.ProfileDirectoryRecursive = test.recursive
+			AppConfig.ProfileInclude, AppConfig.ProfileExclude = nil, test.exclude
+
+			rawList, profileErrors, err := loadProfileDirectory(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(map[string]WireguardProfileEntry(rawList), test.entries) {
+				t.Errorf("entries = %+v, want %+v", rawList, test.entries)
+			}
+
+			if len(profileErrors) != len(test.errors) {
+				t.Errorf("errors = %v, want %v", profileErrors, test.errors)
+			}
+			for key, want := range test.errors {
+				if err := profileErrors[key]; err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("error of %s = %v, want %q", key, err, want)
+				}
+			}
+
+		})
+	}
+
+	if _, _, err := loadProfileDirectory(filepath.Join(dir, "missing")); err == nil {
+		t.Error("no error for a missing directory")
+	}
+
+}
+
+func TestDeriveSingleProfileID(t *testing.T) {
+
+	id := deriveSingleProfileID("W0ludGVyZmFjZV0K")
+	if !strings.HasPrefix(id, "single_") || len(id) != len("single_")+4 {
+		t.Fatalf("id = %s, want single_ and 4 hex digits", id)
+	}
+	if len(id)+len(WireguardInterfacePrefix) > 15 {
+		t.Errorf("interface name of %s is longer than 15", id)
+	}
+
+	if again := deriveSingleProfileID("W0ludGVyZmFjZV0K"); again != id {
+		t.Errorf("id of the same value = %s, want %s", again, id)
+	}
+	if other := deriveSingleProfileID("W1BlZXJdCg=="); other == id {
+		t.Errorf("id of another value = %s, want a different id", other)
+	}
+	if invalid := deriveSingleProfileID("not base64!"); !strings.HasPrefix(invalid, "single_") {
+		t.Errorf("id of an invalid value = %s", invalid)
+	}
+
+}
+
+func TestLoadProfileRawPrecedence(t *testing.T) {
+
+	defer func(single, singleID, remote, file, dir string) {
+		AppConfig.ProfileDataSingle, AppConfig.ProfileIDSingle, AppConfig.RemoteProfilePath = single, singleID, remote
+		WireguardProfileFilePath, WireguardProfileDirectoryPath = file, dir
+	}(AppConfig.ProfileDataSingle, AppConfig.ProfileIDSingle, AppConfig.RemoteProfilePath, WireguardProfileFilePath, WireguardProfileDirectoryPath)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"remote": "UkVNT1RF"}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	profileFile := filepath.Join(dir, "profile.json")
+	if err := os.WriteFile(profileFile, []byte(`{"file": "RklMRQ=="}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	profileDir := filepath.Join(dir, "wireguard")
+	if err := os.Mkdir(profileDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(profileDir, "directory.conf"), []byte("DIR"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		single   string
+		singleID string
+		remote   string
+		file     string
+		id       string
+	}{
+		{name: "single", single: "U0lO R0xF\n", remote: server.URL, file: profileFile, id: deriveSingleProfileID("U0lOR0xF")},
+		{name: "single with id", single: "U0lOR0xF", singleID: "mine", remote: server.URL, file: profileFile, id: "mine"},
+		{name: "remote", remote: server.URL, file: profileFile, id: "remote"},
+		{name: "file", file: profileFile, id: "file"},
+		{name: "directory", file: filepath.Join(dir, "missing.json"), id: "directory"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			AppConfig.ProfileDataSingle, AppConfig.ProfileIDSingle, AppConfig.RemoteProfilePath = test.single, test.singleID, test.remote
+			WireguardProfileFilePath, WireguardProfileDirectoryPath = test.file, profileDir
+
+			rawList, _, err := loadProfileRaw()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rawList) != 1 {
+				t.Fatalf("profiles = %v, want only %s", rawList, test.id)
+			}
+			if _, ok := rawList[test.id]; !ok {
+				t.Errorf("profiles = %v, want %s", rawList, test.id)
+			}
+
+		})
+	}
+
+}
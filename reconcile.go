@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// NetnsPath is where named network namespaces of WG_NETNS are mounted
+const NetnsPath = "/var/run/netns"
+
+// reconcileNetwork removes what a previous run left behind when it was killed before its teardown:
+// wg_ interfaces and namespaces with their routes, and the rules and endpoint routes of RouterProtocol.
+// Rules and routes of other owners are never touched, whatever their table or metric is.
+// The tunnels of another running instance in the same network namespace would be removed as well, so WG_CLEANUP enables it.
+func reconcileNetwork() {
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Cannot list links // %s", err.Error()))
+	}
+
+	wireguardLinks := make(map[int]bool)
+	for _, link := range links {
+		if strings.HasPrefix(link.Attrs().Name, WireguardInterfacePrefix) {
+			wireguardLinks[link.Attrs().Index] = true
+		}
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Cannot list rules // %s", err.Error()))
+		}
+		for _, rule := range rules {
+			if !isStaleRule(rule) {
+				continue
+			}
+			rule := rule
+			reconcileRemove(fmt.Sprintf("rule %s", rule.String()), netlink.RuleDel(&rule))
+		}
+
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: syscall.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Cannot list routes // %s", err.Error()))
+		}
+		for _, route := range routes {
+			if !wireguardLinks[route.LinkIndex] && route.Protocol != RouterProtocol {
+				continue
+			}
+			route := route
+			reconcileRemove(fmt.Sprintf("route %s table %d", route.Dst, route.Table), netlink.RouteDel(&route))
+		}
+
+	}
+
+	for _, link := range links {
+		if !wireguardLinks[link.Attrs().Index] {
+			continue
+		}
+		reconcileRemove(fmt.Sprintf("link %s", link.Attrs().Name), netlink.LinkDel(link))
+	}
+
+	entries, _ := os.ReadDir(NetnsPath)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), WireguardInterfacePrefix) {
+			continue
+		}
+		reconcileRemove(fmt.Sprintf("netns %s", entry.Name()), netns.DeleteNamed(entry.Name()))
+	}
+
+}
+
+// isStaleRule reports whether rule points at a routing table of a profile and was added by this tool or uses a wg_ interface
+func isStaleRule(rule netlink.Rule) bool {
+
+	if rule.Table < RouterTableBase {
+		return false
+	}
+
+	return rule.Protocol == RouterProtocol ||
+		strings.HasPrefix(rule.IifName, WireguardInterfacePrefix) ||
+		strings.HasPrefix(rule.OifName, WireguardInterfacePrefix)
+
+}
+
+func reconcileRemove(description string, err error) {
+	if err != nil {
+		debugMessage(DEBUG_SHOW_ERROR_MESSAGE, fmt.Sprintf("Cannot remove stale %s // %s", description, err.Error()))
+		return
+	}
+	debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Removed stale %s", description))
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// ResultSchemaVersion is increased whenever a field of the result json changes its meaning.
+// 1 had only status and message per profile.
+const ResultSchemaVersion = 2
+
+// Error codes are stable identifiers of a failure for alerting. The message stays free text.
+const (
+	ErrorCodeProfileParse     = "PROFILE_PARSE"     // profile could not be read or parsed
+	ErrorCodeEndpointResolve  = "ENDPOINT_RESOLVE"  // peer endpoint hostname could not be resolved
+	ErrorCodeTunnelStart      = "TUNNEL_START"      // wireguard interface could not be created
+	ErrorCodeUAPI             = "UAPI_ERROR"        // wireguard rejected the configuration or the uapi socket failed
+	ErrorCodeHandshakeTimeout = "HANDSHAKE_TIMEOUT" // a peer did not complete a handshake in HANDSHAKE_TIMEOUT
+	ErrorCodeRouteSetup       = "ROUTE_SETUP"       // addresses, routes or rules could not be added
+	ErrorCodeCheckTimeout     = "CHECK_TIMEOUT"     // health check got no answer
+	ErrorCodeCheckRefused     = "CHECK_REFUSED"     // health check target refused the connection
+	ErrorCodeCheckError       = "CHECK_ERROR"       // health check failed for another reason
+	ErrorCodeHTTPStatus       = "HTTP_STATUS"       // http health check got a status which is not accepted
+	ErrorCodeHTTPAssertion    = "HTTP_ASSERTION"    // http health check response did not satisfy an assertion
+	ErrorCodeTLS              = "TLS_ERROR"         // certificate of the health check target could not be verified or matched no pin
+	ErrorCodeDNSRCode         = "DNS_RCODE"         // dns health check got an rcode which is not accepted
+	ErrorCodeDNSAnswer        = "DNS_ANSWER"        // dns health check answer did not contain an expected value
+	ErrorCodeRunTimeout       = "RUN_TIMEOUT"       // RUNTIMEOUT expired before the profile was finished
+	ErrorCodeInterrupted      = "INTERRUPTED"       // SIGINT or SIGTERM was received before the profile was finished
+)
+
+// CodedError attaches an error code to an error
+type CodedError struct {
+	Code string
+	Err  error
+}
+
+func (e *CodedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CodedError) Unwrap() error {
+	return e.Err
+}
+
+func newCodedError(code string, err error) error {
+	return &CodedError{Code: code, Err: err}
+}
+
+// errorCode returns the error code of err, or "" if it has none
+func errorCode(err error) string {
+
+	var codedError *CodedError
+	var handshakeError *HandshakeError
+	var resolveError *EndpointResolveError
+
+	switch {
+	case errors.As(err, &codedError):
+		return codedError.Code
+	case errors.As(err, &handshakeError):
+		return ErrorCodeHandshakeTimeout
+	case errors.As(err, &resolveError):
+		return ErrorCodeEndpointResolve
+	}
+
+	return ""
+
+}
+
+// errorCodeClass returns the coarse error class of an error code
+func errorCodeClass(code string) string {
+	switch code {
+	case ErrorCodeProfileParse:
+		return ErrorClassProfile
+	case ErrorCodeEndpointResolve:
+		return ErrorClassEndpointResolve
+	case ErrorCodeTunnelStart, ErrorCodeUAPI, ErrorCodeRouteSetup:
+		return ErrorClassTunnel
+	case ErrorCodeHandshakeTimeout:
+		return ErrorClassHandshake
+	case ErrorCodeCheckTimeout, ErrorCodeCheckRefused, ErrorCodeCheckError, ErrorCodeHTTPStatus, ErrorCodeHTTPAssertion, ErrorCodeTLS, ErrorCodeDNSRCode, ErrorCodeDNSAnswer:
+		return ErrorClassHealthCheck
+	case ErrorCodeRunTimeout:
+		return ErrorClassRunTimeout
+	case ErrorCodeInterrupted:
+		return ErrorClassInterrupted
+	}
+	return ""
+}
+
+const (
+	ErrorClassProfile         = "profile"          // profile could not be read or parsed
+	ErrorClassEndpointResolve = "endpoint_resolve" // peer endpoint hostname could not be resolved
+	ErrorClassTunnel          = "tunnel"           // wireguard or routes could not be set up
+	ErrorClassHandshake       = "handshake"        // tunnel is set up but a peer did not complete a handshake
+	ErrorClassHealthCheck     = "healthcheck"      // tunnel is up but the health check failed
+	ErrorClassRunTimeout      = "runtimeout"       // RUNTIMEOUT expired
+	ErrorClassInterrupted     = "interrupted"      // SIGINT or SIGTERM was received
+)
+
+type JobResult struct {
+	ProfileID         string
+	WorkerID          int
+	Backend           string // backend of the tunnel, which differs from WG_BACKEND after a fallback
+	Profile           *WireguardQuickConf
+	SuccessMessage    string
+	Error             error
+	ErrorCode         string
+	Policy            string // HEALTHCHECK_POLICY
+	Checks            []*CheckResult
+	ResolvedEndpoints map[string]string
+	Timing            JobTiming
+	Tunnel            *TunnelResult
+}
+
+// JobTiming is the time spent in each phase of a job
+type JobTiming struct {
+	TunnelUp  time.Duration // wireguard process, uapi configuration and routes
+	Handshake time.Duration
+	Check     time.Duration
+	Teardown  time.Duration
+}
+
+// TunnelResult is the state of the wireguard interface right before it is torn down
+type TunnelResult struct {
+	RxBytes int64              `json:"rxbytes"`
+	TxBytes int64              `json:"txbytes"`
+	Peers   []TunnelPeerResult `json:"peers"`
+}
+
+type TunnelPeerResult struct {
+	PublicKey      string `json:"publickey"`
+	Endpoint       string `json:"endpoint"` // endpoint actually used by wireguard
+	RxBytes        int64  `json:"rxbytes"`
+	TxBytes        int64  `json:"txbytes"`
+	LastHandshake  string `json:"lasthandshake,omitempty"`
+	HandshakeAgeMs *int64 `json:"handshakeagems,omitempty"`
+}
+
+func newTunnelResult(device *UAPIDevice) *TunnelResult {
+
+	tunnel := &TunnelResult{}
+
+	for _, peer := range device.Peers {
+
+		peerResult := TunnelPeerResult{
+			PublicKey: convertHexKeyBase64Encoding(peer.PublicKey),
+			Endpoint:  peer.Endpoint,
+			RxBytes:   peer.RxBytes,
+			TxBytes:   peer.TxBytes,
+		}
+
+		if !peer.LastHandshakeTime.IsZero() {
+			handshakeAge := time.Since(peer.LastHandshakeTime).Milliseconds()
+			peerResult.LastHandshake = peer.LastHandshakeTime.Format(time.RFC3339Nano)
+			peerResult.HandshakeAgeMs = &handshakeAge
+		}
+
+		tunnel.RxBytes += peer.RxBytes
+		tunnel.TxBytes += peer.TxBytes
+		tunnel.Peers = append(tunnel.Peers, peerResult)
+
+	}
+
+	return tunnel
+
+}
+
+// collectTunnelResult reads the transfer counters and handshakes of the tunnel. nil if it is not available.
+func collectTunnelResult(tunnel WireguardTunnel) *TunnelResult {
+
+	if tunnel == nil {
+		return nil
+	}
+
+	device, err := tunnelDevice(tunnel)
+	if err != nil {
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("[%s] cannot read tunnel state // %s", tunnel.Name(), err.Error()))
+		return nil
+	}
+
+	return newTunnelResult(device)
+
+}
+
+// ErrorSuccessResult is the result of a profile. Durations are in milliseconds.
+type ErrorSuccessResult struct {
+	Success           string                        `json:"status"`
+	ErrorMessage      string                        `json:"message"` // free text, kept for schema version 1 readers
+	ErrorClass        string                        `json:"errorclass,omitempty"`
+	ErrorCode         string                        `json:"code,omitempty"`
+	Name              string                        `json:"name,omitempty"` // name of a check in checks
+	ProfileID         string                        `json:"profile,omitempty"`
+	Label             string                        `json:"label,omitempty"`
+	Tags              []string                      `json:"tags,omitempty"`
+	WorkerID          int                           `json:"worker,omitempty"`
+	Backend           string                        `json:"backend,omitempty"`
+	Addresses         []string                      `json:"address,omitempty"`
+	Endpoint          string                        `json:"endpoint,omitempty"`
+	ResolvedEndpoints map[string]string             `json:"resolved,omitempty"` // key=endpoint hostname
+	Method            string                        `json:"method,omitempty"`
+	Source            string                        `json:"source,omitempty"`
+	Target            string                        `json:"target,omitempty"`
+	Attempts          int                           `json:"attempts,omitempty"`
+	RTTs              []float64                     `json:"rtts,omitempty"`
+	Latency           *LatencyResult                `json:"latency,omitempty"`
+	PacketLoss        *float64                      `json:"loss,omitempty"` // percent
+	Assertion         string                        `json:"assertion,omitempty"`
+	HTTP              *HTTPResult                   `json:"http,omitempty"`
+	TLS               *TLSResult                    `json:"tls,omitempty"`
+	DNS               *DNSResult                    `json:"dns,omitempty"`
+	DNSServers        []DNSServerResult             `json:"dnsservers,omitempty"`
+	Timing            *TimingResult                 `json:"timing,omitempty"`
+	Tunnel            *TunnelResult                 `json:"tunnel,omitempty"`
+	Families          map[string]ErrorSuccessResult `json:"families,omitempty"` // key=ipv4,ipv6
+	Policy            string                        `json:"policy,omitempty"`
+	Checks            []ErrorSuccessResult          `json:"checks,omitempty"` // in the order of HEALTHCHECKS
+}
+
+type LatencyResult struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+type TimingResult struct {
+	TunnelUp  float64 `json:"tunnelup"`
+	Handshake float64 `json:"handshake"`
+	Check     float64 `json:"check"`
+	Teardown  float64 `json:"teardown"`
+}
+
+// durationMilliseconds keeps microsecond precision
+func durationMilliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+// CheckResult is the result of one check of HEALTHCHECKS, run once per ip family
+type CheckResult struct {
+	Name           string
+	Method         string
+	Families       []*HealthCheckResult
+	SuccessMessage string
+	Error          error
+	ErrorCode      string
+}
+
+// newCheckResult merges the results of every ip family. The check fails if any family fails.
+func newCheckResult(name string, method string, hrs []*HealthCheckResult) *CheckResult {
+
+	check := &CheckResult{
+		Name:     name,
+		Method:   method,
+		Families: hrs,
+	}
+
+	var successMessages, errorMessages []string
+	for _, hr := range hrs {
+		if hr.Error != nil {
+			if check.ErrorCode == "" {
+				check.ErrorCode = hr.ErrorCode
+			}
+			errorMessages = append(errorMessages, hr.Error.Error())
+		} else {
+			successMessages = append(successMessages, hr.SuccessMessage)
+		}
+	}
+
+	if len(errorMessages) > 0 {
+		check.Error = errors.New(strings.Join(errorMessages, " / "))
+	} else {
+		check.SuccessMessage = strings.Join(successMessages, " / ")
+	}
+
+	return check
+
+}
+
+// newJobResult decides the status of a profile from its checks by the policy
+func newJobResult(profileId string, checks []*CheckResult, policy string) JobResult {
+
+	jobResult := JobResult{
+		ProfileID: profileId,
+		Policy:    policy,
+		Checks:    checks,
+	}
+
+	passed := 0
+	firstErrorCode := ""
+
+	var successMessages, errorMessages []string
+	for _, check := range checks {
+		if check.Error != nil {
+			if firstErrorCode == "" {
+				firstErrorCode = check.ErrorCode
+			}
+			errorMessages = append(errorMessages, check.Error.Error())
+		} else {
+			passed++
+			successMessages = append(successMessages, check.SuccessMessage)
+		}
+	}
+
+	if passed < healthCheckQuorum(policy, len(checks)) {
+		jobResult.Error = errors.New(strings.Join(errorMessages, " / "))
+		jobResult.ErrorCode = firstErrorCode
+	} else {
+		jobResult.SuccessMessage = strings.Join(successMessages, " / ")
+	}
+
+	return jobResult
+
+}
+
+func newErrorSuccessResult(r JobResult) ErrorSuccessResult {
+
+	var result ErrorSuccessResult
+
+	if r.Error == nil {
+		result = ErrorSuccessResult{
+			Success:      "ok",
+			ErrorMessage: r.SuccessMessage,
+		}
+	} else {
+		result = ErrorSuccessResult{
+			Success:      "error",
+			ErrorMessage: r.Error.Error(),
+			ErrorClass:   errorCodeClass(r.ErrorCode),
+			ErrorCode:    r.ErrorCode,
+		}
+	}
+
+	// Handshake failures have their own status to tell crypto/endpoint problems from routing/upstream problems
+	if result.ErrorClass == ErrorClassHandshake {
+		result.Success = "handshake_failed"
+	}
+
+	result.ProfileID = r.ProfileID
+	result.WorkerID = r.WorkerID
+	result.Backend = r.Backend
+	result.ResolvedEndpoints = r.ResolvedEndpoints
+	result.Tunnel = r.Tunnel
+
+	if r.Profile != nil {
+		result.Label = r.Profile.Settings.Label
+		result.Tags = r.Profile.Settings.Tags
+		result.Addresses = r.Profile.Interface.Addresses
+		for _, peer := range r.Profile.Peers {
+			if peer.Endpoint != "" {
+				result.Endpoint = peer.Endpoint
+				break
+			}
+		}
+	}
+
+	if r.Timing != (JobTiming{}) {
+		result.Timing = &TimingResult{
+			TunnelUp:  durationMilliseconds(r.Timing.TunnelUp),
+			Handshake: durationMilliseconds(r.Timing.Handshake),
+			Check:     durationMilliseconds(r.Timing.Check),
+			Teardown:  durationMilliseconds(r.Timing.Teardown),
+		}
+	}
+
+	// A single check is shown in the profile itself, like before HEALTHCHECKS
+	if len(r.Checks) == 1 {
+		result.setCheckResult(r.Checks[0])
+	} else if len(r.Checks) > 1 {
+		result.Policy = r.Policy
+		for _, check := range r.Checks {
+			checkResult := newErrorSuccessResult(JobResult{
+				SuccessMessage: check.SuccessMessage,
+				Error:          check.Error,
+				ErrorCode:      check.ErrorCode,
+			})
+			checkResult.Name = check.Name
+			checkResult.setCheckResult(check)
+			result.Checks = append(result.Checks, checkResult)
+		}
+	}
+
+	return result
+
+}
+
+// newProfileErrorResult is the result of a profile which failed before it could run. PROFILE_PARSE if err has no code.
+func newProfileErrorResult(profileId string, err error) ErrorSuccessResult {
+
+	code := errorCode(err)
+	if code == "" {
+		code = ErrorCodeProfileParse
+	}
+
+	result := ErrorSuccessResult{
+		Success:      "error",
+		ErrorMessage: fmt.Sprintf("%s error: %s", errorCodeClass(code), err.Error()),
+		ErrorClass:   errorCodeClass(code),
+		ErrorCode:    code,
+		ProfileID:    profileId,
+	}
+
+	var entryError *ProfileEntryError
+	if errors.As(err, &entryError) {
+		result.Label = entryError.Label
+		result.Tags = entryError.Tags
+	}
+
+	return result
+
+}
+
+func (result *ErrorSuccessResult) setCheckResult(check *CheckResult) {
+
+	// Check details are shown per family when more than one family was tested
+	if len(check.Families) == 1 {
+		result.setHealthCheckResult(check.Families[0])
+	} else if len(check.Families) > 1 {
+		result.Method = check.Method
+		result.Families = make(map[string]ErrorSuccessResult)
+		for _, hr := range check.Families {
+			familyResult := newErrorSuccessResult(JobResult{
+				SuccessMessage: hr.SuccessMessage,
+				Error:          hr.Error,
+				ErrorCode:      hr.ErrorCode,
+			})
+			familyResult.setHealthCheckResult(hr)
+			result.Families[fmt.Sprintf("ipv%d", hr.Family)] = familyResult
+		}
+	}
+
+}
+
+func (result *ErrorSuccessResult) setHealthCheckResult(hr *HealthCheckResult) {
+
+	result.Method = hr.Method
+	result.Source = hr.Source
+	result.Target = hr.Target
+	result.Attempts = hr.Attempts
+	result.Assertion = hr.Assertion
+	result.HTTP = hr.HTTP
+	result.TLS = hr.TLS
+	result.DNS = hr.DNS
+	result.DNSServers = hr.DNSServers
+
+	if len(hr.RTTs) > 0 {
+		var sum time.Duration
+		latency := &LatencyResult{
+			Min: durationMilliseconds(hr.RTTs[0]),
+			Max: durationMilliseconds(hr.RTTs[0]),
+		}
+		for _, rtt := range hr.RTTs {
+			result.RTTs = append(result.RTTs, durationMilliseconds(rtt))
+			latency.Min = math.Min(latency.Min, durationMilliseconds(rtt))
+			latency.Max = math.Max(latency.Max, durationMilliseconds(rtt))
+			sum += rtt
+		}
+		latency.Avg = durationMilliseconds(sum / time.Duration(len(hr.RTTs)))
+		result.Latency = latency
+	}
+
+	if packetLoss := hr.PacketLoss(); packetLoss >= 0 {
+		result.PacketLoss = &packetLoss
+	}
+
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewJobResult(t *testing.T) {
+
+	pass := &CheckResult{SuccessMessage: "pass"}
+	timeout := &CheckResult{Error: errors.New("timeout"), ErrorCode: ErrorCodeCheckTimeout}
+	refused := &CheckResult{Error: errors.New("refused"), ErrorCode: ErrorCodeCheckRefused}
+
+	tests := []struct {
+		name    string
+		policy  string
+		checks  []*CheckResult
+		code    string // "" if the profile passes
+		message string
+	}{
+		{name: "all pass", policy: "all", checks: []*CheckResult{pass, pass}, message: "pass / pass"},
+		{name: "all with a failure", policy: "all", checks: []*CheckResult{pass, timeout, refused}, code: ErrorCodeCheckTimeout, message: "timeout / refused"},
+		{name: "any with a pass", policy: "any", checks: []*CheckResult{refused, timeout, pass}, message: "pass"},
+		{name: "any without a pass", policy: "any", checks: []*CheckResult{refused, timeout}, code: ErrorCodeCheckRefused, message: "refused / timeout"},
+		{name: "quorum met", policy: "quorum:2", checks: []*CheckResult{pass, timeout, pass}, message: "pass / pass"},
+		{name: "quorum not met", policy: "quorum:2", checks: []*CheckResult{pass, timeout, refused}, code: ErrorCodeCheckTimeout, message: "timeout / refused"},
+		{name: "quorum of every check", policy: "quorum:3", checks: []*CheckResult{pass, pass, pass}, message: "pass / pass / pass"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := newJobResult("p", test.checks, test.policy)
+
+			if test.code == "" {
+				if r.Error != nil {
+					t.Fatalf("error = %v, want success", r.Error)
+				}
+				if r.SuccessMessage != test.message {
+					t.Errorf("message = %q, want %q", r.SuccessMessage, test.message)
+				}
+				return
+			}
+
+			if r.Error == nil || r.Error.Error() != test.message {
+				t.Fatalf("error = %v, want %q", r.Error, test.message)
+			}
+			if r.ErrorCode != test.code {
+				t.Errorf("code = %s, want %s", r.ErrorCode, test.code)
+			}
+
+		})
+	}
+
+}
+
+func TestResultMessageCounts(t *testing.T) {
+
+	defer func(status map[string]ErrorSuccessResult) {
+		JobResultStatus = status
+	}(JobResultStatus)
+
+	passed := JobResult{ProfileID: "a", SuccessMessage: "pass"}
+	failed := newJobResult("b", []*CheckResult{{Error: errors.New("timeout"), ErrorCode: ErrorCodeCheckTimeout}}, HealthCheckPolicyAll)
+
+	tests := []struct {
+		name          string
+		profiles      []string
+		profileErrors map[string]error
+		results       []JobResult
+		total         int
+		proceed       int
+		errors        int
+		succeed       int
+		status        string
+	}{
+		{name: "every profile passes", profiles: []string{"a"}, results: []JobResult{passed}, total: 1, proceed: 1, succeed: 1, status: "ok"},
+		{name: "a check fails", profiles: []string{"a", "b"}, results: []JobResult{passed, failed}, total: 2, proceed: 2, errors: 1, succeed: 1, status: "error"},
+		{
+			name:          "a profile fails to load",
+			profiles:      []string{"a"},
+			profileErrors: map[string]error{"c": errors.New("Address is empty")},
+			results:       []JobResult{passed},
+			total:         2, proceed: 2, errors: 1, succeed: 1, status: "error",
+		},
+		{
+			name:          "only load failures",
+			profileErrors: map[string]error{"c": errors.New("Address is empty"), "d": errors.New("PrivateKey is empty")},
+			total:         2, proceed: 2, errors: 2, status: "error",
+		},
+		{name: "a profile is not proceeded", profiles: []string{"a", "b"}, results: []JobResult{passed}, total: 2, proceed: 1, succeed: 1, status: "error"},
+		{name: "no profile", status: "error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			JobResultStatus = make(map[string]ErrorSuccessResult)
+
+			profileList := make(WireguardProfileList)
+			for _, profileId := range test.profiles {
+				profileList[profileId] = WireguardQuickConf{ProfileID: profileId}
+			}
+
+			resultMessage := newResultMessage(profileList, test.profileErrors)
+			for _, r := range test.results {
+				collectJobResult(&resultMessage, r)
+			}
+			resultMessage.setStatus()
+
+			if resultMessage.DesiredCheckCount != test.total || resultMessage.ProceedCount != test.proceed ||
+				resultMessage.ErrorCount != test.errors || resultMessage.SucceedCount != test.succeed {
+				t.Errorf("total/proceed/errors/succeed = %d/%d/%d/%d, want %d/%d/%d/%d",
+					resultMessage.DesiredCheckCount, resultMessage.ProceedCount, resultMessage.ErrorCount, resultMessage.SucceedCount,
+					test.total, test.proceed, test.errors, test.succeed)
+			}
+			if resultMessage.Status != test.status {
+				t.Errorf("status = %s, want %s", resultMessage.Status, test.status)
+			}
+			for profileId := range test.profileErrors {
+				if result := JobResultStatus[profileId]; result.ErrorCode != ErrorCodeProfileParse {
+					t.Errorf("code of %s = %q, want %s", profileId, result.ErrorCode, ErrorCodeProfileParse)
+				}
+			}
+
+		})
+	}
+
+}
+
+func TestErrorCode(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		err   error
+		code  string
+		class string
+	}{
+		{name: "coded", err: newCodedError(ErrorCodeRouteSetup, errors.New("file exists")), code: ErrorCodeRouteSetup, class: ErrorClassTunnel},
+		{name: "wrapped coded", err: fmt.Errorf("setup: %w", newCodedError(ErrorCodeTunnelStart, errors.New("exists"))), code: ErrorCodeTunnelStart, class: ErrorClassTunnel},
+		{name: "handshake", err: &HandshakeError{PublicKey: "02", Timeout: time.Second}, code: ErrorCodeHandshakeTimeout, class: ErrorClassHandshake},
+		{name: "endpoint", err: fmt.Errorf("peer: %w", &EndpointResolveError{Host: "vpn.example.com", Err: errors.New("no such host")}), code: ErrorCodeEndpointResolve, class: ErrorClassEndpointResolve},
+		{name: "coded wins", err: newCodedError(ErrorCodeUAPI, &HandshakeError{PublicKey: "02"}), code: ErrorCodeUAPI, class: ErrorClassTunnel},
+		{name: "uncoded", err: errors.New("other")},
+		{name: "profile", err: newCodedError(ErrorCodeProfileParse, errors.New("x")), code: ErrorCodeProfileParse, class: ErrorClassProfile},
+		{name: "check", err: newCodedError(ErrorCodeDNSAnswer, errors.New("x")), code: ErrorCodeDNSAnswer, class: ErrorClassHealthCheck},
+		{name: "tls", err: newCodedError(ErrorCodeTLS, errors.New("x")), code: ErrorCodeTLS, class: ErrorClassHealthCheck},
+		{name: "run timeout", err: newCodedError(ErrorCodeRunTimeout, errors.New("x")), code: ErrorCodeRunTimeout, class: ErrorClassRunTimeout},
+		{name: "interrupted", err: newCodedError(ErrorCodeInterrupted, errors.New("x")), code: ErrorCodeInterrupted, class: ErrorClassInterrupted},
+		{name: "unknown code", err: newCodedError("SOMETHING", errors.New("x")), code: "SOMETHING"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code := errorCode(test.err)
+			if code != test.code {
+				t.Errorf("errorCode = %q, want %q", code, test.code)
+			}
+			if class := errorCodeClass(code); class != test.class {
+				t.Errorf("errorCodeClass = %q, want %q", class, test.class)
+			}
+		})
+	}
+
+}
+
+func TestNewErrorSuccessResult(t *testing.T) {
+
+	profile := &WireguardQuickConf{
+		Settings:  ProfileSettings{Label: "Site A", Tags: []string{"prod"}},
+		Interface: WireguardQuickInterface{Addresses: []string{"10.0.0.2/32"}},
+		Peers:     []WireguardQuickPeer{{}, {Endpoint: "vpn.example.com:51820"}},
+	}
+
+	tests := []struct {
+		name     string
+		r        JobResult
+		status   string
+		code     string
+		class    string
+		message  string
+		endpoint string
+	}{
+		{
+			name:     "ok",
+			r:        JobResult{ProfileID: "a", Profile: profile, SuccessMessage: "rtt=1ms"},
+			status:   "ok",
+			message:  "rtt=1ms",
+			endpoint: "vpn.example.com:51820",
+		},
+		{
+			name:    "check error",
+			r:       JobResult{ProfileID: "a", Error: errors.New("no answer"), ErrorCode: ErrorCodeCheckTimeout},
+			status:  "error",
+			code:    ErrorCodeCheckTimeout,
+			class:   ErrorClassHealthCheck,
+			message: "no answer",
+		},
+		{
+			name:    "handshake",
+			r:       JobResult{ProfileID: "a", Error: errors.New("no handshake"), ErrorCode: ErrorCodeHandshakeTimeout},
+			status:  "handshake_failed",
+			code:    ErrorCodeHandshakeTimeout,
+			class:   ErrorClassHandshake,
+			message: "no handshake",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			result := newErrorSuccessResult(test.r)
+
+			if result.Success != test.status || result.ErrorCode != test.code || result.ErrorClass != test.class || result.ErrorMessage != test.message {
+				t.Errorf("status/code/class/message = %s/%s/%s/%q, want %s/%s/%s/%q",
+					result.Success, result.ErrorCode, result.ErrorClass, result.ErrorMessage, test.status, test.code, test.class, test.message)
+			}
+			if result.ProfileID != test.r.ProfileID {
+				t.Errorf("profile = %s, want %s", result.ProfileID, test.r.ProfileID)
+			}
+			if result.Endpoint != test.endpoint {
+				t.Errorf("endpoint = %s, want %s", result.Endpoint, test.endpoint)
+			}
+			if test.r.Profile != nil && (result.Label != "Site A" || len(result.Tags) != 1 || len(result.Addresses) != 1) {
+				t.Errorf("label/tags/address = %s/%v/%v, want the settings of the profile", result.Label, result.Tags, result.Addresses)
+			}
+
+		})
+	}
+
+}
+
+func TestNewProfileErrorResult(t *testing.T) {
+
+	entryError := (ProfileSettings{Label: "Site A", Tags: []string{"prod"}}).entryError(errors.New("Address is empty"))
+
+	tests := []struct {
+		name    string
+		err     error
+		code    string
+		class   string
+		message string
+		label   string
+	}{
+		{name: "parse", err: errors.New("Address is empty"), code: ErrorCodeProfileParse, class: ErrorClassProfile, message: "profile error: Address is empty"},
+		{name: "entry", err: entryError, code: ErrorCodeProfileParse, class: ErrorClassProfile, message: "profile error: Address is empty", label: "Site A"},
+		{
+			name:    "resolve",
+			err:     &EndpointResolveError{Host: "vpn.example.com", Err: errors.New("no such host")},
+			code:    ErrorCodeEndpointResolve,
+			class:   ErrorClassEndpointResolve,
+			message: "endpoint_resolve error: cannot resolve endpoint vpn.example.com: no such host",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := newProfileErrorResult("p", test.err)
+			if result.Success != "error" || result.ErrorCode != test.code || result.ErrorClass != test.class || result.ErrorMessage != test.message {
+				t.Errorf("status/code/class/message = %s/%s/%s/%q, want error/%s/%s/%q",
+					result.Success, result.ErrorCode, result.ErrorClass, result.ErrorMessage, test.code, test.class, test.message)
+			}
+			if result.Label != test.label {
+				t.Errorf("label = %q, want %q", result.Label, test.label)
+			}
+		})
+	}
+
+}
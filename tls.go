@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsCheckOptions are the options of health checks over TLS. The certificate is verified unless insecure is set.
+type tlsCheckOptions struct {
+	Insecure   bool     `json:"insecure"`   // skip the certificate verification, pins are still checked
+	CA         string   `json:"ca"`         // PEM file of the CAs which are trusted instead of the system roots
+	ServerName string   `json:"servername"` // SNI and the name which the certificate is verified for
+	SPKIPins   []string `json:"spkipins"`   // base64 sha256 of the SubjectPublicKeyInfo of a certificate of the chain
+	CertPins   []string `json:"certpins"`   // hex sha256 of a certificate of the chain
+}
+
+// TLSResult is the TLS connection of a health check
+type TLSResult struct {
+	Version     string `json:"version,omitempty"`
+	CipherSuite string `json:"cipher,omitempty"`
+	Subject     string `json:"subject"`
+	Issuer      string `json:"issuer"`
+	NotAfter    string `json:"notafter"`
+	ExpiryDays  int    `json:"expirydays"` // days until the leaf certificate expires, negative if it has expired
+}
+
+// TLSError is a certificate which could not be verified or matched no pin
+type TLSError struct {
+	Assertion string // tls or pins
+	Err       error
+}
+
+func (e *TLSError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+// clientConfig returns the tls.Config of the options. Pins are checked by verifyPins.
+func (o tlsCheckOptions) clientConfig() (*tls.Config, error) {
+
+	config := &tls.Config{
+		InsecureSkipVerify: o.Insecure,
+		ServerName:         o.ServerName,
+	}
+
+	if o.CA != "" {
+		data, err := os.ReadFile(o.CA)
+		if err != nil {
+			return nil, fmt.Errorf("ca error: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ca error: %s has no PEM certificate", o.CA)
+		}
+	}
+
+	for _, pin := range o.SPKIPins {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("spkipins error: %s is not a base64 sha256", pin)
+		}
+	}
+
+	for _, pin := range o.CertPins {
+		sum, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("certpins error: %s is not a hex sha256", pin)
+		}
+	}
+
+	return config, nil
+
+}
+
+// verifyPins returns an error if pins are set and no certificate of the chain matches one of them
+func (o tlsCheckOptions) verifyPins(certificates []*x509.Certificate) error {
+
+	if len(o.SPKIPins) == 0 && len(o.CertPins) == 0 {
+		return nil
+	}
+
+	for _, certificate := range certificates {
+
+		spki := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		for _, pin := range o.SPKIPins {
+			if strings.TrimPrefix(pin, "sha256//") == base64.StdEncoding.EncodeToString(spki[:]) {
+				return nil
+			}
+		}
+
+		fingerprint := sha256.Sum256(certificate.Raw)
+		for _, pin := range o.CertPins {
+			if strings.EqualFold(strings.ReplaceAll(pin, ":", ""), hex.EncodeToString(fingerprint[:])) {
+				return nil
+			}
+		}
+
+	}
+
+	return &TLSError{Assertion: "pins", Err: fmt.Errorf("no certificate of the chain matches a pin")}
+
+}
+
+// verifiedConfig returns a copy of config which checks the pins and records the connection in result
+func (o tlsCheckOptions) verifiedConfig(config *tls.Config, result **TLSResult) *tls.Config {
+
+	config = config.Clone()
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		*result = newTLSResult(cs.Version, cs.CipherSuite, cs.PeerCertificates)
+		return o.verifyPins(cs.PeerCertificates)
+	}
+
+	return config
+
+}
+
+func newTLSResult(version uint16, cipherSuite uint16, certificates []*x509.Certificate) *TLSResult {
+
+	result := &TLSResult{}
+
+	if version != 0 {
+		result.Version = tls.VersionName(version)
+		result.CipherSuite = tls.CipherSuiteName(cipherSuite)
+	}
+
+	if len(certificates) > 0 {
+		leaf := certificates[0]
+		result.Subject = leaf.Subject.String()
+		result.Issuer = leaf.Issuer.String()
+		result.NotAfter = leaf.NotAfter.Format(time.RFC3339)
+		result.ExpiryDays = int(time.Until(leaf.NotAfter).Hours() / 24)
+	}
+
+	return result
+
+}
+
+// tlsErrorResult returns the TLSError of a failed handshake and the certificates which the server presented.
+// The certificates are nil if err is not about the certificate.
+func tlsErrorResult(err error) (*TLSError, *TLSResult) {
+
+	var tlsError *TLSError
+	if errors.As(err, &tlsError) {
+		return tlsError, nil
+	}
+
+	var verificationError *tls.CertificateVerificationError
+	if errors.As(err, &verificationError) {
+		return &TLSError{Assertion: "tls", Err: verificationError.Err}, newTLSResult(0, 0, verificationError.UnverifiedCertificates)
+	}
+
+	return nil, nil
+
+}
+
+// tlsCheckError returns an ErrorCodeTLS error of a failed handshake and records the certificates and the assertion in hr.
+// Other errors are returned as they are.
+func tlsCheckError(err error, hr *HealthCheckResult) error {
+
+	tlsError, tlsResult := tlsErrorResult(err)
+	if tlsError == nil {
+		return err
+	}
+
+	if tlsResult != nil {
+		hr.TLS = tlsResult
+	}
+	hr.Assertion = tlsError.Assertion
+
+	return newCodedError(ErrorCodeTLS, err)
+
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPins(t *testing.T) {
+
+	leaf := &x509.Certificate{Raw: []byte("leaf"), RawSubjectPublicKeyInfo: []byte("leaf spki")}
+	intermediate := &x509.Certificate{Raw: []byte("intermediate"), RawSubjectPublicKeyInfo: []byte("intermediate spki")}
+	chain := []*x509.Certificate{leaf, intermediate}
+
+	spkiPin := func(certificate *x509.Certificate) string {
+		sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	certPin := func(certificate *x509.Certificate) string {
+		sum := sha256.Sum256(certificate.Raw)
+		return hex.EncodeToString(sum[:])
+	}
+	colons := func(pin string) string {
+		var parts []string
+		for i := 0; i < len(pin); i += 2 {
+			parts = append(parts, strings.ToUpper(pin[i:i+2]))
+		}
+		return strings.Join(parts, ":")
+	}
+	otherSum := sha256.Sum256([]byte("other"))
+	otherSPKIPin := base64.StdEncoding.EncodeToString(otherSum[:])
+	otherCertPin := hex.EncodeToString(otherSum[:])
+
+	tests := []struct {
+		name    string
+		options tlsCheckOptions
+		match   bool
+	}{
+		{name: "no pins", match: true},
+		{name: "spki of leaf", options: tlsCheckOptions{SPKIPins: []string{spkiPin(leaf)}}, match: true},
+		{name: "spki of intermediate with prefix", options: tlsCheckOptions{SPKIPins: []string{otherSPKIPin, "sha256//" + spkiPin(intermediate)}}, match: true},
+		{name: "cert of leaf", options: tlsCheckOptions{CertPins: []string{certPin(leaf)}}, match: true},
+		{name: "cert with colons", options: tlsCheckOptions{CertPins: []string{colons(certPin(intermediate))}}, match: true},
+		{name: "spki or cert", options: tlsCheckOptions{SPKIPins: []string{otherSPKIPin}, CertPins: []string{certPin(leaf)}}, match: true},
+		{name: "other spki", options: tlsCheckOptions{SPKIPins: []string{otherSPKIPin}}},
+		{name: "other cert", options: tlsCheckOptions{CertPins: []string{otherCertPin}}},
+		{name: "spki given as cert pin", options: tlsCheckOptions{CertPins: []string{hex.EncodeToString([]byte(spkiPin(leaf)))}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			err := test.options.verifyPins(chain)
+			if test.match {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			tlsError, ok := err.(*TLSError)
+			if !ok || tlsError.Assertion != "pins" {
+				t.Fatalf("error = %v, want a pins TLSError", err)
+			}
+
+		})
+	}
+
+}
+
+func TestTLSCheckOptionsPins(t *testing.T) {
+
+	sum := sha256.Sum256([]byte("pin"))
+
+	tests := []struct {
+		name    string
+		options tlsCheckOptions
+		err     string
+	}{
+		{name: "valid", options: tlsCheckOptions{
+			SPKIPins: []string{base64.StdEncoding.EncodeToString(sum[:]), "sha256//" + base64.StdEncoding.EncodeToString(sum[:])},
+			CertPins: []string{hex.EncodeToString(sum[:]), strings.ToUpper(hex.EncodeToString(sum[:]))},
+		}},
+		{name: "spki not base64", options: tlsCheckOptions{SPKIPins: []string{"not base64!"}}, err: "spkipins error"},
+		{name: "spki too short", options: tlsCheckOptions{SPKIPins: []string{base64.StdEncoding.EncodeToString(sum[:16])}}, err: "spkipins error"},
+		{name: "spki as hex", options: tlsCheckOptions{SPKIPins: []string{hex.EncodeToString(sum[:])}}, err: "spkipins error"},
+		{name: "cert not hex", options: tlsCheckOptions{CertPins: []string{strings.Repeat("zz", sha256.Size)}}, err: "certpins error"},
+		{name: "cert too long", options: tlsCheckOptions{CertPins: []string{hex.EncodeToString(sum[:]) + "00"}}, err: "certpins error"},
+		{name: "cert as base64", options: tlsCheckOptions{CertPins: []string{base64.StdEncoding.EncodeToString(sum[:])}}, err: "certpins error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			_, err := test.options.clientConfig()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("error = %v, want %q", err, test.err)
+			}
+
+		})
+	}
+
+}
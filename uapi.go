@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Wireguard cross-platform userspace API
+// https://www.wireguard.com/xplatform/
+
+const UAPIRequestTimeout = 3 * time.Second
+
+// HandshakeError means the tunnel was set up but a peer did not complete a handshake in time.
+// Wrong keys and unreachable endpoints end up here rather than as a health check timeout.
+type HandshakeError struct {
+	PublicKey string
+	Timeout   time.Duration
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake failed: peer %s did not complete a handshake in %dms", convertHexKeyBase64Encoding(e.PublicKey), e.Timeout.Milliseconds())
+}
+
+func uapiSocketPath(wireguardInterfaceName string) string {
+	return fmt.Sprintf("/var/run/wireguard/%s.sock", wireguardInterfaceName)
+}
+
+// uapiRequest sends one set or get operation and reads the whole response up to the empty line.
+// The errno line is checked and removed from the returned response.
+func uapiRequest(conn net.Conn, request string) (string, error) {
+
+	conn.SetDeadline(time.Now().Add(UAPIRequestTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	_, err := conn.Write([]byte(request))
+	if err != nil {
+		return "", err
+	}
+
+	var response strings.Builder
+	reader := bufio.NewReader(conn)
+
+	for {
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+
+		if strings.HasPrefix(line, "errno=") {
+			if line != "errno=0" {
+				return "", fmt.Errorf("wireguard got error %s", line)
+			}
+			continue
+		}
+
+		response.WriteString(line)
+		response.WriteString("\n")
+
+	}
+
+	debugMessage(DEBUG_SHOW_CHAOS_MESSAGE, response.String())
+
+	return response.String(), nil
+
+}
+
+type UAPIDevice struct {
+	PrivateKey string
+	ListenPort int
+	FwMark     int
+	Peers      []UAPIPeer
+}
+
+type UAPIPeer struct {
+	PublicKey                   string
+	Endpoint                    string
+	LastHandshakeTime           time.Time // zero if there was no handshake
+	RxBytes                     int64
+	TxBytes                     int64
+	PersistentKeepaliveInterval int
+	AllowedIPs                  []string
+	ProtocolVersion             int
+}
+
+// Peer returns the peer of the public key (hex)
+func (d *UAPIDevice) Peer(publicKey string) *UAPIPeer {
+	for i := range d.Peers {
+		if d.Peers[i].PublicKey == publicKey {
+			return &d.Peers[i]
+		}
+	}
+	return nil
+}
+
+// parseUAPIGetResponse parses the key=value lines of a get=1 response.
+// Device keys come first, then every public_key line starts a new peer.
+func parseUAPIGetResponse(response string) (*UAPIDevice, error) {
+
+	device := &UAPIDevice{}
+	var peer *UAPIPeer
+	var handshakeSec, handshakeNsec int64
+
+	flushHandshake := func() {
+		if peer != nil && (handshakeSec != 0 || handshakeNsec != 0) {
+			peer.LastHandshakeTime = time.Unix(handshakeSec, handshakeNsec)
+		}
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	for _, line := range strings.Split(response, "\n") {
+
+		if line == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid uapi line %q", line)
+		}
+
+		var err error
+
+		if key == "public_key" {
+			flushHandshake()
+			device.Peers = append(device.Peers, UAPIPeer{PublicKey: value})
+			peer = &device.Peers[len(device.Peers)-1]
+			continue
+		}
+
+		if peer == nil {
+			switch key {
+			case "private_key":
+				device.PrivateKey = value
+			case "listen_port":
+				device.ListenPort, err = strconv.Atoi(value)
+			case "fwmark":
+				device.FwMark, err = strconv.Atoi(value)
+			}
+		} else {
+			switch key {
+			case "endpoint":
+				peer.Endpoint = value
+			case "last_handshake_time_sec":
+				handshakeSec, err = strconv.ParseInt(value, 10, 64)
+			case "last_handshake_time_nsec":
+				handshakeNsec, err = strconv.ParseInt(value, 10, 64)
+			case "rx_bytes":
+				peer.RxBytes, err = strconv.ParseInt(value, 10, 64)
+			case "tx_bytes":
+				peer.TxBytes, err = strconv.ParseInt(value, 10, 64)
+			case "persistent_keepalive_interval":
+				peer.PersistentKeepaliveInterval, err = strconv.Atoi(value)
+			case "allowed_ip":
+				peer.AllowedIPs = append(peer.AllowedIPs, value)
+			case "protocol_version":
+				peer.ProtocolVersion, err = strconv.Atoi(value)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid uapi value %q", line)
+		}
+
+	}
+
+	flushHandshake()
+
+	return device, nil
+
+}
+
+// waitHandshake makes every peer with an endpoint initiate a handshake and polls get=1 until all of them have one.
+func waitHandshake(ctx context.Context, tunnel WireguardTunnel, profile WireguardQuickConf, timeout time.Duration) (time.Duration, error) {
+
+	startTime := time.Now()
+
+	// A keepalive is sent when persistent_keepalive_interval becomes non-zero on a running device,
+	// and it needs a handshake first. The profile value is restored afterwards.
+	var trigger, restore strings.Builder
+
+	var waitPeers []string
+	for _, peer := range profile.Peers {
+		if peer.EndpointIP == "" {
+			continue
+		}
+		waitPeers = append(waitPeers, peer.PublicKey)
+
+		keepalive := peer.PersistentKeepalive
+		if keepalive == 0 {
+			keepalive = 25
+		}
+		fmt.Fprintf(&trigger, "public_key=%s\nupdate_only=true\npersistent_keepalive_interval=0\npersistent_keepalive_interval=%d\n", peer.PublicKey, keepalive)
+		fmt.Fprintf(&restore, "public_key=%s\nupdate_only=true\npersistent_keepalive_interval=%d\n", peer.PublicKey, peer.PersistentKeepalive)
+	}
+	// Peers without an endpoint only answer handshakes, so there is nothing to wait for
+	if len(waitPeers) == 0 {
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("[%s] no peer has an endpoint, handshake is not awaited", profile.ProfileID))
+		return 0, nil
+	}
+
+	err := tunnel.IpcSet(trigger.String())
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		err := tunnel.IpcSet(restore.String())
+		if err != nil {
+			debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, fmt.Sprintf("cannot restore persistent keepalive // %s", err.Error()))
+		}
+	}()
+
+	for {
+
+		device, err := tunnelDevice(tunnel)
+		if err != nil {
+			return 0, err
+		}
+
+		pendingPeer := ""
+		for _, publicKey := range waitPeers {
+			if peer := device.Peer(publicKey); peer == nil || peer.LastHandshakeTime.IsZero() {
+				pendingPeer = publicKey
+				break
+			}
+		}
+
+		if pendingPeer == "" {
+			return time.Since(startTime), nil
+		}
+
+		if time.Since(startTime) > timeout {
+			return 0, &HandshakeError{PublicKey: pendingPeer, Timeout: timeout}
+		}
+
+		err = sleepContext(ctx, 100*time.Millisecond)
+		if err != nil {
+			return 0, err
+		}
+
+	}
+
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUAPIGetResponse(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		response string
+		device   *UAPIDevice
+		err      bool
+	}{
+		{
+			name:     "device only",
+			response: "private_key=01\nlisten_port=51820\nfwmark=51820\n",
+			device:   &UAPIDevice{PrivateKey: "01", ListenPort: 51820, FwMark: 51820},
+		},
+		{
+			name: "peers",
+			response: "private_key=01\nlisten_port=0\n" +
+				"public_key=02\nendpoint=192.0.2.1:51820\nlast_handshake_time_sec=1700000000\nlast_handshake_time_nsec=5\n" +
+				"rx_bytes=92\ntx_bytes=148\npersistent_keepalive_interval=25\nallowed_ip=0.0.0.0/0\nallowed_ip=::/0\nprotocol_version=1\n" +
+				"public_key=03\nendpoint=[2001:db8::1]:51820\nlast_handshake_time_sec=0\nlast_handshake_time_nsec=0\nallowed_ip=10.0.0.0/8\n",
+			device: &UAPIDevice{
+				PrivateKey: "01",
+				Peers: []UAPIPeer{
+					{
+						PublicKey:                   "02",
+						Endpoint:                    "192.0.2.1:51820",
+						LastHandshakeTime:           time.Unix(1700000000, 5),
+						RxBytes:                     92,
+						TxBytes:                     148,
+						PersistentKeepaliveInterval: 25,
+						AllowedIPs:                  []string{"0.0.0.0/0", "::/0"},
+						ProtocolVersion:             1,
+					},
+					{
+						PublicKey:  "03",
+						Endpoint:   "[2001:db8::1]:51820",
+						AllowedIPs: []string{"10.0.0.0/8"},
+					},
+				},
+			},
+		},
+		{
+			name:     "unknown keys",
+			response: "private_key=01\nunknown=1\npublic_key=02\nunknown=2\n",
+			device:   &UAPIDevice{PrivateKey: "01", Peers: []UAPIPeer{{PublicKey: "02"}}},
+		},
+		{
+			name:     "line without value",
+			response: "private_key=01\nlisten_port\n",
+			err:      true,
+		},
+		{
+			name:     "invalid number",
+			response: "public_key=02\nrx_bytes=x\n",
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			device, err := parseUAPIGetResponse(test.response)
+			if test.err {
+				if err == nil {
+					t.Fatalf("no error, device %+v", device)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(device, test.device) {
+				t.Errorf("device = %+v, want %+v", device, test.device)
+			}
+
+		})
+	}
+
+}
+
+// uapiTestTunnel answers get=1 with a fixed response and records every set=1
+type uapiTestTunnel struct {
+	response string
+	sets     []string
+}
+
+func (t *uapiTestTunnel) Name() string    { return "wg_test" }
+func (t *uapiTestTunnel) Backend() string { return WireguardBackendUserspace }
+func (t *uapiTestTunnel) Close() error    { return nil }
+
+func (t *uapiTestTunnel) IpcSet(config string) error {
+	t.sets = append(t.sets, config)
+	return nil
+}
+
+func (t *uapiTestTunnel) IpcGet() (string, error) {
+	return t.response, nil
+}
+
+func TestWaitHandshake(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		peers    []WireguardQuickPeer
+		response string
+		sets     int
+		err      bool
+	}{
+		{
+			name:  "no endpoint",
+			peers: []WireguardQuickPeer{{PublicKey: "02"}},
+		},
+		{
+			name:     "handshake",
+			peers:    []WireguardQuickPeer{{PublicKey: "02", EndpointIP: "192.0.2.1"}, {PublicKey: "03"}},
+			response: "public_key=02\nlast_handshake_time_sec=1700000000\nlast_handshake_time_nsec=0\npublic_key=03\n",
+			sets:     2,
+		},
+		{
+			name:     "no handshake",
+			peers:    []WireguardQuickPeer{{PublicKey: "02", EndpointIP: "192.0.2.1"}},
+			response: "public_key=02\nlast_handshake_time_sec=0\nlast_handshake_time_nsec=0\n",
+			sets:     2,
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			tunnel := &uapiTestTunnel{response: test.response}
+			profile := WireguardQuickConf{ProfileID: "test", Peers: test.peers}
+
+			_, err := waitHandshake(context.Background(), tunnel, profile, time.Millisecond)
+			if test.err {
+				var handshakeErr *HandshakeError
+				if !errors.As(err, &handshakeErr) {
+					t.Fatalf("error = %v, want a HandshakeError", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(tunnel.sets) != test.sets {
+				t.Errorf("IpcSet called %d times, want %d", len(tunnel.sets), test.sets)
+			}
+
+		})
+	}
+
+}
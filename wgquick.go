@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+type WireguardQuickConf struct {
+	ProfileID       string // Not standrard
+	ProfileSequence int
+	Settings        ProfileSettings // object form of profile.json
+	Interface       WireguardQuickInterface
+	Peers           []WireguardQuickPeer
+}
+
+type WireguardQuickInterface struct {
+	Address    string   // first address without prefix, used as the source address of health checks
+	Addresses  []string // every Address entry with its prefix
+	DNS        string
+	DNSs       []string
+	DNSSearch  []string
+	PrivateKey string // hex
+	ListenPort int
+	FwMark     int
+	MTU        int
+	SaveConfig bool
+
+	// kept but never executed
+	PreUp    []string
+	PostUp   []string
+	PreDown  []string
+	PostDown []string
+}
+
+type WireguardQuickPeer struct {
+	AllowedIPs          string
+	AllowedIPss         []string
+	Endpoint            string
+	EndpointHost        string // hostname of Endpoint before it was resolved into EndpointIP
+	EndpointIP          string
+	EndpointPort        string
+	PublicKey           string // hex
+	PresharedKey        string // hex
+	PersistentKeepalive int
+}
+
+// EndpointIP returns the endpoint of the first peer which has one
+func (c WireguardQuickConf) EndpointIP() string {
+	for _, peer := range c.Peers {
+		if peer.EndpointIP != "" {
+			return peer.EndpointIP
+		}
+	}
+	return ""
+}
+
+// ResolvedEndpoints returns the address of every endpoint which was given as a hostname
+func (c WireguardQuickConf) ResolvedEndpoints() map[string]string {
+	var resolved map[string]string
+	for _, peer := range c.Peers {
+		if peer.EndpointHost == "" {
+			continue
+		}
+		if resolved == nil {
+			resolved = make(map[string]string)
+		}
+		resolved[peer.EndpointHost] = peer.EndpointIP
+	}
+	return resolved
+}
+
+// InterfaceAddress returns the first interface address of the ip family (4 or 6) without prefix
+func (c WireguardQuickConf) InterfaceAddress(family int) string {
+	for _, address := range c.Interface.Addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err == nil && ipFamily(ip) == family {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// SharesInterfaceAddress reports whether both profiles use a same interface address
+func (c WireguardQuickConf) SharesInterfaceAddress(o WireguardQuickConf) bool {
+	for _, a := range c.Interface.Addresses {
+		for _, b := range o.Interface.Addresses {
+			if hostPrefixString(a) == hostPrefixString(b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EndpointIPs returns the distinct endpoints of every peer
+func (c WireguardQuickConf) EndpointIPs() []string {
+	var list []string
+	visited := make(map[string]bool)
+	for _, peer := range c.Peers {
+		if peer.EndpointIP == "" || visited[peer.EndpointIP] {
+			continue
+		}
+		visited[peer.EndpointIP] = true
+		list = append(list, peer.EndpointIP)
+	}
+	return list
+}
+
+// SharesEndpoint reports whether a peer of each profile uses a same endpoint
+func (c WireguardQuickConf) SharesEndpoint(o WireguardQuickConf) bool {
+	for _, a := range c.EndpointIPs() {
+		for _, b := range o.EndpointIPs() {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// conflictsWith returns why both profiles cannot run at the same time, or "" if they can.
+// A nonzero ListenPort is bound on the host in every mode. Endpoint routes and interface addresses
+// are only shared if the tunnels use the host network.
+func (c WireguardQuickConf) conflictsWith(o WireguardQuickConf, hostNetwork bool) string {
+	if c.Interface.ListenPort != 0 && c.Interface.ListenPort == o.Interface.ListenPort {
+		return fmt.Sprintf("listen port %d", c.Interface.ListenPort)
+	}
+	if !hostNetwork {
+		return ""
+	}
+	if c.SharesEndpoint(o) {
+		return "endpoint ip"
+	}
+	if c.SharesInterfaceAddress(o) {
+		return "interface ip"
+	}
+	return ""
+}
+
+func parseWireguardQuickProfile(profileId string, seq int, base64EncodedWireguardQuickProfile string) (wgQuickConf WireguardQuickConf, err error) {
+
+	if len(profileId)+len(WireguardInterfacePrefix) > 15 {
+		return wgQuickConf, fmt.Errorf("ifname [%s%s] is too long", WireguardInterfacePrefix, profileId)
+	}
+
+	decodeArray, err := base64.StdEncoding.DecodeString(base64EncodedWireguardQuickProfile)
+	if err != nil {
+		return wgQuickConf, err
+	}
+
+	// wg-quick allows repeated keys (Address, AllowedIPs, PostUp...) and a [Peer] section per peer
+	cfg, err := ini.LoadSources(ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}, decodeArray)
+	if err != nil {
+		debugMessage(DEBUG_SHOW_DEBUG_MESSAGE, string(debug.Stack()))
+		return wgQuickConf, err
+	}
+
+	interfaceSection, err := cfg.GetSection("interface")
+	if err != nil {
+		return wgQuickConf, err
+	}
+
+	wgQuickConf.ProfileID = profileId
+	wgQuickConf.ProfileSequence = seq
+
+	err = parseWireguardQuickInterface(&wgQuickConf.Interface, interfaceSection)
+	if err != nil {
+		return wgQuickConf, fmt.Errorf("profile [%s] %s", profileId, err.Error())
+	}
+
+	peerSections, err := cfg.SectionsByName("peer")
+	if err != nil {
+		return wgQuickConf, fmt.Errorf("profile [%s] has no [Peer] section", profileId)
+	}
+
+	for i, peerSection := range peerSections {
+		var peer WireguardQuickPeer
+		err = parseWireguardQuickPeer(&peer, peerSection)
+		if err != nil {
+			return wgQuickConf, fmt.Errorf("profile [%s] peer#%d %s", profileId, i, err.Error())
+		}
+		wgQuickConf.Peers = append(wgQuickConf.Peers, peer)
+	}
+
+	return wgQuickConf, nil
+
+}
+
+func parseWireguardQuickInterface(wgInterface *WireguardQuickInterface, section *ini.Section) (err error) {
+
+	for _, key := range section.Keys() {
+
+		values := key.ValueWithShadows()
+
+		switch key.Name() {
+		case "address":
+			for _, address := range splitWireguardQuickList(values) {
+				netIP, netIPNet, err := net.ParseCIDR(address)
+				if err == nil {
+					ones, _ := netIPNet.Mask.Size()
+					address = fmt.Sprintf("%s/%d", netIP.String(), ones)
+				} else if netIP = net.ParseIP(address); netIP != nil {
+					address = hostPrefix(netIP)
+				} else {
+					return fmt.Errorf("IP address [%s] is invalid", address)
+				}
+				wgInterface.Addresses = append(wgInterface.Addresses, address)
+				if wgInterface.Address == "" {
+					wgInterface.Address = netIP.String()
+				}
+			}
+		case "dns":
+			for _, dns := range splitWireguardQuickList(values) {
+				if netIP := net.ParseIP(dns); netIP != nil {
+					wgInterface.DNSs = append(wgInterface.DNSs, netIP.String())
+				} else {
+					wgInterface.DNSSearch = append(wgInterface.DNSSearch, dns)
+				}
+			}
+		case "privatekey":
+			wgInterface.PrivateKey, err = convertWireguardQuickConfigurationKeyHexEncoding(key.String())
+			if err != nil {
+				return fmt.Errorf("PrivateKey %s", err.Error())
+			}
+		case "listenport":
+			wgInterface.ListenPort, err = strconv.Atoi(key.String())
+			if err != nil || wgInterface.ListenPort < 0 || wgInterface.ListenPort > 65535 {
+				return fmt.Errorf("ListenPort [%s] is invalid", key.String())
+			}
+		case "fwmark":
+			if key.String() == "off" {
+				continue
+			}
+			fwmark, err := strconv.ParseUint(key.String(), 0, 32)
+			if err != nil {
+				return fmt.Errorf("FwMark [%s] is invalid", key.String())
+			}
+			wgInterface.FwMark = int(fwmark)
+		case "mtu":
+			wgInterface.MTU, err = strconv.Atoi(key.String())
+			if err != nil || wgInterface.MTU < 576 {
+				return fmt.Errorf("MTU [%s] is invalid", key.String())
+			}
+		case "table":
+			// Accepted but not kept, health checks are always routed through a table of this tool
+		case "saveconfig":
+			wgInterface.SaveConfig = key.String() == "true"
+		case "preup":
+			wgInterface.PreUp = append(wgInterface.PreUp, values...)
+		case "postup":
+			wgInterface.PostUp = append(wgInterface.PostUp, values...)
+		case "predown":
+			wgInterface.PreDown = append(wgInterface.PreDown, values...)
+		case "postdown":
+			wgInterface.PostDown = append(wgInterface.PostDown, values...)
+		default:
+			debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Unknown [Interface] key %s", key.Name()))
+		}
+
+	}
+
+	if len(wgInterface.Addresses) == 0 {
+		return errors.New("Address is empty")
+	}
+
+	if wgInterface.PrivateKey == "" {
+		return errors.New("PrivateKey is empty")
+	}
+
+	if len(wgInterface.DNSs) > 0 {
+		wgInterface.DNS = wgInterface.DNSs[0]
+	}
+
+	if len(wgInterface.PreUp)+len(wgInterface.PostUp)+len(wgInterface.PreDown)+len(wgInterface.PostDown) > 0 {
+		debugMessage(DEBUG_SHOW_INFO_MESSAGE, "PreUp/PostUp/PreDown/PostDown are not executed")
+	}
+
+	return nil
+
+}
+
+func parseWireguardQuickPeer(peer *WireguardQuickPeer, section *ini.Section) (err error) {
+
+	for _, key := range section.Keys() {
+
+		values := key.ValueWithShadows()
+
+		switch key.Name() {
+		case "publickey":
+			peer.PublicKey, err = convertWireguardQuickConfigurationKeyHexEncoding(key.String())
+			if err != nil {
+				return fmt.Errorf("PublicKey %s", err.Error())
+			}
+		case "presharedkey":
+			peer.PresharedKey, err = convertWireguardQuickConfigurationKeyHexEncoding(key.String())
+			if err != nil {
+				return fmt.Errorf("PresharedKey %s", err.Error())
+			}
+		case "allowedips":
+			// TODO: AllowedIPs no defualt route
+			for _, allowedIP := range splitWireguardQuickList(values) {
+				_, netIPNet, err := net.ParseCIDR(allowedIP)
+				if err != nil {
+					return fmt.Errorf("AllowedIPs [%s] is invalid", allowedIP)
+				}
+				peer.AllowedIPss = append(peer.AllowedIPss, netIPNet.String())
+			}
+		case "endpoint":
+			// host:port, [v6]:port
+			peer.Endpoint = key.String()
+			peer.EndpointIP, peer.EndpointPort, err = net.SplitHostPort(peer.Endpoint)
+			if err != nil || peer.EndpointIP == "" {
+				return fmt.Errorf("Endpoint [%s] is invalid", peer.Endpoint)
+			}
+			if netIP := net.ParseIP(peer.EndpointIP); netIP != nil {
+				peer.EndpointIP = netIP.String()
+			}
+		case "persistentkeepalive":
+			if key.String() == "off" {
+				continue
+			}
+			peer.PersistentKeepalive, err = strconv.Atoi(key.String())
+			if err != nil || peer.PersistentKeepalive < 0 || peer.PersistentKeepalive > 65535 {
+				return fmt.Errorf("PersistentKeepalive [%s] is invalid", key.String())
+			}
+		default:
+			debugMessage(DEBUG_SHOW_INFO_MESSAGE, fmt.Sprintf("Unknown [Peer] key %s", key.Name()))
+		}
+
+	}
+
+	if peer.PublicKey == "" {
+		return errors.New("PublicKey is empty")
+	}
+
+	if len(peer.AllowedIPss) > 0 {
+		peer.AllowedIPs = peer.AllowedIPss[0]
+	}
+
+	return nil
+
+}
+
+// splitWireguardQuickList flattens repeated and comma separated values
+func splitWireguardQuickList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		list = append(list, splitList(value)...)
+	}
+	return list
+}
+
+// hostPrefix returns ip with a single host prefix length. (/32 or /128)
+func hostPrefix(ip net.IP) string {
+	if ip.To4() != nil {
+		return fmt.Sprintf("%s/32", ip.String())
+	}
+	return fmt.Sprintf("%s/128", ip.String())
+}
+
+// hostPrefixString replaces the prefix length of a CIDR address with a host prefix
+func hostPrefixString(address string) string {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return address
+	}
+	return hostPrefix(ip)
+}
+
+// ipFamily returns 4 or 6
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func convertWireguardQuickConfigurationKeyHexEncoding(s string) (string, error) {
+
+	decodeKey, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+
+	if len(decodeKey) != 32 {
+		return "", fmt.Errorf("key length is %d bytes, not 32 bytes", len(decodeKey))
+	}
+
+	hexString := hex.EncodeToString(decodeKey)
+	return hexString, nil
+}
+
+// convertHexKeyBase64Encoding turns a UAPI key back into the wg-quick form
+func convertHexKeyBase64Encoding(s string) string {
+
+	decodeKey, err := hex.DecodeString(s)
+	if err != nil {
+		return s
+	}
+
+	return base64.StdEncoding.EncodeToString(decodeKey)
+}
+
+// uapiSetCommand builds the body of the wireguard UAPI set=1 operation for the whole profile.
+// defaultFwMark is used when the profile has no FwMark.
+func (c WireguardQuickConf) uapiSetCommand(defaultFwMark int) string {
+
+	fwmark := c.Interface.FwMark
+	if fwmark == 0 {
+		fwmark = defaultFwMark
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", c.Interface.PrivateKey)
+	if c.Interface.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", c.Interface.ListenPort)
+	}
+	fmt.Fprintf(&b, "fwmark=%d\n", fwmark)
+	b.WriteString("replace_peers=true\n")
+
+	for _, peer := range c.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", peer.PublicKey)
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(&b, "preshared_key=%s\n", peer.PresharedKey)
+		}
+		if peer.EndpointIP != "" {
+			fmt.Fprintf(&b, "endpoint=%s\n", net.JoinHostPort(peer.EndpointIP, peer.EndpointPort))
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", peer.PersistentKeepalive)
+		}
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, allowedIP := range peer.AllowedIPss {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", allowedIP)
+		}
+	}
+
+	return b.String()
+
+}
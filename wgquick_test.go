@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWireguardQuickProfile(t *testing.T) {
+
+	privateKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	publicKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	otherPublicKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+
+	tests := []struct {
+		name       string
+		profile    string
+		addresses  []string
+		address    string
+		allowedIPs [][]string
+		endpoints  []string
+		err        string
+	}{
+		{
+			name: "comma separated",
+			profile: `[Interface]
+PrivateKey = ` + privateKey + `
+Address = 10.0.0.2/32, fd00::2/128
+
+[Peer]
+PublicKey = ` + publicKey + `
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 192.0.2.1:51820
+`,
+			addresses:  []string{"10.0.0.2/32", "fd00::2/128"},
+			address:    "10.0.0.2",
+			allowedIPs: [][]string{{"0.0.0.0/0", "::/0"}},
+			endpoints:  []string{"192.0.2.1"},
+		},
+		{
+			name: "repeated lines",
+			profile: `[Interface]
+PrivateKey = ` + privateKey + `
+Address = fd00::2/64
+Address = 10.0.0.2
+Address = 10.0.1.2/24,10.0.2.2/24
+
+[Peer]
+PublicKey = ` + publicKey + `
+AllowedIPs = 10.0.0.0/8
+AllowedIPs = fd00::/8
+Endpoint = [2001:db8::0001]:51820
+`,
+			addresses:  []string{"fd00::2/64", "10.0.0.2/32", "10.0.1.2/24", "10.0.2.2/24"},
+			address:    "fd00::2",
+			allowedIPs: [][]string{{"10.0.0.0/8", "fd00::/8"}},
+			endpoints:  []string{"2001:db8::1"},
+		},
+		{
+			name: "multiple peers",
+			profile: `[Interface]
+PrivateKey = ` + privateKey + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + publicKey + `
+AllowedIPs = 10.0.0.1/32
+Endpoint = 192.0.2.1:51820
+
+[Peer]
+PublicKey = ` + otherPublicKey + `
+AllowedIPs = 10.0.0.3/32, 192.168.0.0/16
+Endpoint = [2001:db8::3]:51821
+`,
+			addresses:  []string{"10.0.0.2/24"},
+			address:    "10.0.0.2",
+			allowedIPs: [][]string{{"10.0.0.1/32"}, {"10.0.0.3/32", "192.168.0.0/16"}},
+			endpoints:  []string{"192.0.2.1", "2001:db8::3"},
+		},
+		{
+			name: "invalid address",
+			profile: `[Interface]
+PrivateKey = ` + privateKey + `
+Address = 10.0.0.2/32, 10.0.0.300/32
+
+[Peer]
+PublicKey = ` + publicKey + `
+`,
+			err: "IP address [10.0.0.300/32] is invalid",
+		},
+		{
+			name: "invalid endpoint",
+			profile: `[Interface]
+PrivateKey = ` + privateKey + `
+Address = 10.0.0.2/32
+
+[Peer]
+PublicKey = ` + publicKey + `
+Endpoint = 2001:db8::1:51820
+`,
+			err: "Endpoint [2001:db8::1:51820] is invalid",
+		},
+		{
+			name: "table off",
+			profile: `[Interface]
+PrivateKey = ` + privateKey + `
+Address = 10.0.0.2/32
+Table = off
+
+[Peer]
+PublicKey = ` + publicKey + `
+AllowedIPs = 0.0.0.0/0
+Endpoint = 192.0.2.1:51820
+`,
+			addresses:  []string{"10.0.0.2/32"},
+			address:    "10.0.0.2",
+			allowedIPs: [][]string{{"0.0.0.0/0"}},
+			endpoints:  []string{"192.0.2.1"},
+		},
+		{
+			name: "no peer",
+			profile: `[Interface]
+PrivateKey = ` + privateKey + `
+Address = 10.0.0.2/32
+`,
+			err: "has no [Peer] section",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			conf, err := parseWireguardQuickProfile("test", 1, base64.StdEncoding.EncodeToString([]byte(test.profile)))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(conf.Interface.Addresses, test.addresses) {
+				t.Errorf("Addresses = %v, want %v", conf.Interface.Addresses, test.addresses)
+			}
+			if conf.Interface.Address != test.address {
+				t.Errorf("Address = %s, want %s", conf.Interface.Address, test.address)
+			}
+
+			var allowedIPs [][]string
+			for _, peer := range conf.Peers {
+				allowedIPs = append(allowedIPs, peer.AllowedIPss)
+			}
+			if !reflect.DeepEqual(allowedIPs, test.allowedIPs) {
+				t.Errorf("AllowedIPs = %v, want %v", allowedIPs, test.allowedIPs)
+			}
+			if !reflect.DeepEqual(conf.EndpointIPs(), test.endpoints) {
+				t.Errorf("EndpointIPs = %v, want %v", conf.EndpointIPs(), test.endpoints)
+			}
+
+		})
+	}
+
+}
+
+func TestSharesEndpoint(t *testing.T) {
+
+	profile := func(endpoints ...string) WireguardQuickConf {
+		var conf WireguardQuickConf
+		for _, endpoint := range endpoints {
+			conf.Peers = append(conf.Peers, WireguardQuickPeer{EndpointIP: endpoint})
+		}
+		return conf
+	}
+
+	tests := []struct {
+		name string
+		a    WireguardQuickConf
+		b    WireguardQuickConf
+		want bool
+	}{
+		{name: "same first peer", a: profile("192.0.2.1"), b: profile("192.0.2.1"), want: true},
+		{name: "same later peer", a: profile("192.0.2.1", "192.0.2.3"), b: profile("192.0.2.2", "192.0.2.3"), want: true},
+		{name: "distinct peers", a: profile("192.0.2.1", "2001:db8::1"), b: profile("192.0.2.2", "2001:db8::2"), want: false},
+		{name: "no endpoint", a: profile(""), b: profile(""), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.a.SharesEndpoint(test.b); got != test.want {
+				t.Errorf("SharesEndpoint = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+}
+
+func TestConflictsWith(t *testing.T) {
+
+	profile := func(listenPort int, address string, endpoint string) WireguardQuickConf {
+		var conf WireguardQuickConf
+		conf.Interface.ListenPort = listenPort
+		conf.Interface.Addresses = []string{address}
+		conf.Peers = []WireguardQuickPeer{{EndpointIP: endpoint}}
+		return conf
+	}
+
+	tests := []struct {
+		name        string
+		a           WireguardQuickConf
+		b           WireguardQuickConf
+		hostNetwork bool
+		reason      string
+	}{
+		{name: "same listen port", a: profile(51820, "10.0.0.2/32", "192.0.2.1"), b: profile(51820, "10.0.0.3/32", "192.0.2.2"), reason: "listen port 51820"},
+		{name: "same listen port on host network", a: profile(51820, "10.0.0.2/32", "192.0.2.1"), b: profile(51820, "10.0.0.3/32", "192.0.2.2"), hostNetwork: true, reason: "listen port 51820"},
+		{name: "random listen port", a: profile(0, "10.0.0.2/32", "192.0.2.1"), b: profile(0, "10.0.0.3/32", "192.0.2.2"), hostNetwork: true},
+		{name: "other listen port", a: profile(51820, "10.0.0.2/32", "192.0.2.1"), b: profile(51821, "10.0.0.3/32", "192.0.2.2"), hostNetwork: true},
+		{name: "same endpoint", a: profile(0, "10.0.0.2/32", "192.0.2.1"), b: profile(0, "10.0.0.3/32", "192.0.2.1"), hostNetwork: true, reason: "endpoint ip"},
+		{name: "same endpoint off host network", a: profile(0, "10.0.0.2/32", "192.0.2.1"), b: profile(0, "10.0.0.3/32", "192.0.2.1")},
+		{name: "same address", a: profile(0, "10.0.0.2/32", "192.0.2.1"), b: profile(0, "10.0.0.2/24", "192.0.2.2"), hostNetwork: true, reason: "interface ip"},
+		{name: "same address off host network", a: profile(0, "10.0.0.2/32", "192.0.2.1"), b: profile(0, "10.0.0.2/24", "192.0.2.2")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reason := test.a.conflictsWith(test.b, test.hostNetwork); reason != test.reason {
+				t.Errorf("conflictsWith = %q, want %q", reason, test.reason)
+			}
+		})
+	}
+
+}